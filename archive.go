@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archiver/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// arcFile is a file on disk to be stored in an archive under name
+type arcFile struct {
+	fp   string
+	name string
+	fi   os.FileInfo
+}
+
+// arcLevels maps compression level choices to flate levels
+var arcLevels = map[string]int{
+	"fast":   flate.BestSpeed,
+	"normal": flate.DefaultCompression,
+	"best":   flate.BestCompression,
+}
+
+var arcTypes = map[string]string{
+	"zip":     "application/zip",
+	"tar.gz":  "application/gzip",
+	"tar.zst": "application/zstd",
+}
+
+// downArchive streams selected files as an archive, symlinks leading outside
+// of root are left out unless root is empty
+func downArchive(w http.ResponseWriter, uDir string, uFiles []string, format, root string) {
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	ct, ok := arcTypes[format]
+	if !ok {
+		htErr(w, "download", fmt.Errorf("unsupported archive format %q", format))
+		return
+	}
+	if len(uFiles) == 0 {
+		htErr(w, "download", fmt.Errorf("no files selected"))
+		return
+	}
+	fl, sz, err := arcList(uDir, uFiles, root)
+	if err != nil {
+		htErr(w, "download", err)
+		return
+	}
+	an := arcName(uDir, uFiles) + "." + format
+	log.Printf("Download archive Dir=%v Files=%v Entries=%v Size=%v", uDir, uFiles, len(fl), sz)
+
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+an+"\";")
+	w.Header().Set("Cache-Control", *cacheCtl)
+	err = writeArchive(context.Background(), nil, w, format, fl, flate.DefaultCompression)
+	if err != nil {
+		// headers are already sent, nothing else we can do
+		log.Printf("archive %v: %v", an, err)
+	}
+}
+
+// arcName returns archive name without extension for files selected in uDir
+func arcName(uDir string, uFiles []string) string {
+	an := filepath.Base(uDir)
+	if len(uFiles) == 1 {
+		an = filepath.Base(uFiles[0])
+	}
+	if an == "/" || an == "." {
+		an = "wfm"
+	}
+	return an
+}
+
+// compressFiles packs uFiles from uDir in to a new archive uName in uDst in background
+func compressFiles(w http.ResponseWriter, uDir string, uFiles []string, uDst, uName, format, level, eSort, user string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if deniedPfx(uDir) || deniedPfx(uDst) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	switch format {
+	case "zip", "tar.gz", "tar.xz", "tar.zst":
+	case "7z":
+		if !have7z() {
+			htErr(w, "compress", fmt.Errorf("7z program not found, see -compress_7z"))
+			return
+		}
+	default:
+		htErr(w, "compress", fmt.Errorf("unsupported archive format %q", format))
+		return
+	}
+	l, ok := arcLevels[level]
+	if !ok {
+		l = flate.DefaultCompression
+	}
+	if len(uFiles) == 0 {
+		htErr(w, "compress", fmt.Errorf("no files selected"))
+		return
+	}
+	n := filepath.Base(uName)
+	if n == "." || n == "/" {
+		htErr(w, "compress", fmt.Errorf("archive name is empty"))
+		return
+	}
+	if !strings.HasSuffix(strings.ToLower(n), "."+format) {
+		n += "." + format
+	}
+	dst := filepath.Clean(uDst + "/" + n)
+	if deniedPfx(dst) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	fl, sz, err := arcList(uDir, uFiles, "")
+	if err != nil {
+		htErr(w, "compress", err)
+		return
+	}
+	// the archive gets a numbered name if dst exists by the time it's done
+	out := dst
+	j := jobs.start(user, fmt.Sprintf("compress %v from %v to %v", strings.Join(uFiles, ", "), uDir, dst), func(ctx context.Context, j *job) error {
+		j.setTotal(int64(sz))
+		if format == "7z" {
+			return compress7z(ctx, j, uDir, dst, fl, level, &out)
+		}
+		f, err := os.CreateTemp(filepath.Dir(dst), ".wfm-archive-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		b := bufio.NewWriter(f)
+		err = writeArchive(ctx, j, b, format, fl, l)
+		if err == nil {
+			err = b.Flush()
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+		return finishArchive(j, f.Name(), dst, &out)
+	})
+	jobRedirectFunc(w, j, func() string {
+		j.Lock()
+		defer j.Unlock()
+		return *wfmPfx + "?dir=" + url.QueryEscape(filepath.Clean(uDst)) + "&sort=" + eSort + "&hi=" + url.QueryEscape(filepath.Base(out))
+	}, uDir, eSort)
+}
+
+// finishArchive moves a complete temporary archive to dst without replacing
+// anything, a numbered name is used if dst exists, the final path is stored
+// in out under the job lock
+func finishArchive(j *job, tmp, dst string, out *string) error {
+	err := os.Chmod(tmp, 0644)
+	if err != nil {
+		return err
+	}
+	fp := dst
+	for i := 1; ; i++ {
+		err = renameNoClobber(tmp, fp)
+		if !os.IsExist(err) {
+			break
+		}
+		fp = numberedName(dst, i)
+	}
+	if err != nil {
+		return err
+	}
+	j.Lock()
+	*out = fp
+	j.Unlock()
+	fi, err := os.Stat(fp)
+	if err == nil {
+		j.Lock()
+		j.Result = fmt.Sprintf("%v, %v", filepath.Base(fp), humanize.Bytes(uint64(fi.Size())))
+		j.Unlock()
+	}
+	return nil
+}
+
+// have7z tells if the external program for creating 7z archives is available
+func have7z() bool {
+	if *sevenZip == "" {
+		return false
+	}
+	_, err := exec.LookPath(*sevenZip)
+	return err == nil
+}
+
+// compress7z creates dst with the external 7z program, only files from fl are
+// passed in a list file so 7z doesn't recurse in to anything arcList skipped,
+// which also means empty folders are not stored
+func compress7z(ctx context.Context, j *job, uDir, dst string, fl []arcFile, level string, out *string) error {
+	d, err := os.MkdirTemp(filepath.Dir(dst), ".wfm-archive-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(d)
+	var lst strings.Builder
+	var sz int64
+	n := 0
+	for _, f := range fl {
+		if f.fi.IsDir() {
+			continue
+		}
+		if strings.ContainsAny(f.name, "\r\n") {
+			return fmt.Errorf("%v: file names with line breaks can't be stored in 7z", f.name)
+		}
+		lst.WriteString(f.name + "\n")
+		sz += f.fi.Size()
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("no files to compress")
+	}
+	err = ioutil.WriteFile(d+"/list", []byte(lst.String()), 0600)
+	if err != nil {
+		return err
+	}
+	mx := "5"
+	switch level {
+	case "fast":
+		mx = "1"
+	case "best":
+		mx = "9"
+	}
+	tmp := d + "/archive.7z"
+	c := exec.CommandContext(ctx, *sevenZip, "a", "-t7z", "-mx="+mx, "-bd", "-y", "-spd", "-scsUTF-8", tmp, "@"+d+"/list")
+	c.Dir = uDir
+	o, err := c.CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		m := strings.TrimSpace(string(o))
+		if i := strings.LastIndex(m, "\n"); i >= 0 {
+			m = m[i+1:]
+		}
+		return fmt.Errorf("%v: %v %v", *sevenZip, err, m)
+	}
+	j.progress(sz, n)
+	return finishArchive(j, tmp, dst, out)
+}
+
+// arcList walks selected files in uDir the same way listFiles shows them, following
+// symlinks and skipping broken ones, denied prefixes and dot files, up to size and entry caps,
+// when root is set symlinks resolving outside of it are skipped too
+func arcList(uDir string, uFiles []string, root string) ([]arcFile, uint64, error) {
+	fl := []arcFile{}
+	var sz uint64
+	seen := make(map[[2]uint64]bool)
+
+	var add func(fp, name string) error
+	add = func(fp, name string) error {
+		if deniedPfx(fp) || (!*showDot && strings.HasPrefix(path.Base(name), ".")) {
+			return nil
+		}
+		fi, err := os.Lstat(fp)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+			t, err := filepath.EvalSymlinks(fp)
+			if err != nil || deniedPfx(t) {
+				return nil
+			}
+			if root != "" && t != root && !strings.HasPrefix(t, root+"/") {
+				return nil
+			}
+			fi, err = os.Stat(fp)
+			if err != nil {
+				return nil
+			}
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.IsDir() {
+			// symlink loop
+			id := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		if len(fl) >= *arcMaxFiles {
+			return fmt.Errorf("too many files, limit is %v", *arcMaxFiles)
+		}
+		fl = append(fl, arcFile{fp: fp, name: name, fi: fi})
+		if !fi.IsDir() {
+			sz += uint64(fi.Size())
+			if arcMaxSize > 0 && sz > uint64(arcMaxSize) {
+				return fmt.Errorf("archive too large, limit is %v", arcMaxSize.String())
+			}
+			return nil
+		}
+		d, err := ioutil.ReadDir(fp)
+		if err != nil {
+			return err
+		}
+		for _, f := range d {
+			err = add(fp+"/"+f.Name(), name+"/"+f.Name())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, f := range uFiles {
+		b := filepath.Base(f)
+		err := add(uDir+"/"+b, b)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return fl, sz, nil
+}
+
+// writeArchive streams files to w as zip, tar.gz, tar.xz or tar.zst, level is
+// a flate compression level which is mapped to similar settings of xz and zstd,
+// j is optional for reporting progress of archives created in background
+func writeArchive(ctx context.Context, j *job, w io.Writer, format string, fl []arcFile, level int) error {
+	if format == "zip" {
+		return writeZip(ctx, j, w, fl, level)
+	}
+	var cw io.WriteCloser
+	var err error
+	switch format {
+	case "tar.gz":
+		cw, err = archiver.Gz{CompressionLevel: level}.OpenWriter(w)
+	case "tar.xz":
+		c := xz.WriterConfig{DictCap: 8 << 20}
+		switch level {
+		case flate.BestSpeed:
+			c.DictCap = 1 << 20
+		case flate.BestCompression:
+			c.DictCap = 64 << 20
+		}
+		cw, err = c.NewWriter(w)
+	case "tar.zst":
+		l := zstd.SpeedDefault
+		switch level {
+		case flate.BestSpeed:
+			l = zstd.SpeedFastest
+		case flate.BestCompression:
+			l = zstd.SpeedBestCompression
+		}
+		cw, err = archiver.Zstd{EncoderOptions: []zstd.EOption{zstd.WithEncoderLevel(l)}}.OpenWriter(w)
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	err = writeTar(ctx, j, cw, fl)
+	if err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+func writeZip(ctx context.Context, j *job, w io.Writer, fl []arcFile, level int) error {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+	for _, f := range fl {
+		h, err := zip.FileInfoHeader(f.fi)
+		if err != nil {
+			return err
+		}
+		h.Name = f.name
+		h.Method = zip.Deflate
+		if f.fi.IsDir() {
+			h.Name += "/"
+			h.Method = zip.Store
+		}
+		o, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		if f.fi.IsDir() {
+			continue
+		}
+		err = copyFileTo(ctx, j, o, f.fp, f.fi.Size())
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTar(ctx context.Context, j *job, w io.Writer, fl []arcFile) error {
+	tw := tar.NewWriter(w)
+	for _, f := range fl {
+		h, err := tar.FileInfoHeader(f.fi, "")
+		if err != nil {
+			return err
+		}
+		h.Name = f.name
+		if f.fi.IsDir() {
+			h.Name += "/"
+		}
+		err = tw.WriteHeader(h)
+		if err != nil {
+			return err
+		}
+		if f.fi.IsDir() {
+			continue
+		}
+		err = copyFileTo(ctx, j, tw, f.fp, f.fi.Size())
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// copyFileTo copies exactly size bytes as recorded in the archive header
+func copyFileTo(ctx context.Context, j *job, w io.Writer, fp string, size int64) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if j != nil {
+		r = &jobReader{ctx: ctx, j: j, r: f}
+	}
+	_, err = io.CopyN(w, r, size)
+	if err == nil && j != nil {
+		j.progress(0, 1)
+	}
+	return err
+}
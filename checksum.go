@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// checksums are computed by background jobs and cached by path, size and mtime,
+// the algorithm of an expected checksum is taken from a BSD style tag or the
+// checksum file name, otherwise it's told by its length
+
+var (
+	sumCache = newSumCache()
+	sumAlgs  = []string{"MD5", "SHA-1", "SHA-256", "SHA-512", "BLAKE2b-512"}
+	sumLen   = map[int][]string{32: {"MD5"}, 40: {"SHA-1"}, 64: {"SHA-256"}, 128: {"SHA-512", "BLAKE2b-512"}}
+	sumHex   = regexp.MustCompile(`(?i)\b[0-9a-f]{32,128}\b`)
+	sumGnu   = regexp.MustCompile(`^\\?([0-9a-fA-F]{32,128}) [ *](.+)$`)
+	sumBsd   = regexp.MustCompile(`^([A-Za-z0-9-]+) \((.+)\) = ([0-9a-fA-F]{32,128})$`)
+	sumTags  = map[string]string{"MD5": "MD5", "SHA1": "SHA-1", "SHA256": "SHA-256", "SHA512": "SHA-512", "BLAKE2b": "BLAKE2b-512"}
+	sumFiles = map[string]string{"SHA512SUMS": "SHA-512", "SHA256SUMS": "SHA-256", "SHA1SUMS": "SHA-1", "MD5SUMS": "MD5", "B2SUMS": "BLAKE2b-512", "CHECKSUM": "", "CHECKSUMS": ""}
+	sumExts  = map[string]string{".sha512": "SHA-512", ".sha512sum": "SHA-512", ".sha256": "SHA-256", ".sha256sum": "SHA-256",
+		".sha1": "SHA-1", ".sha1sum": "SHA-1", ".md5": "MD5", ".md5sum": "MD5", ".b2": "BLAKE2b-512"}
+)
+
+type fileSums struct {
+	size  int64
+	mtime time.Time
+	at    time.Time
+	sums  map[string]string
+}
+
+// sumCheck is expected checksum of a file and where it came from,
+// alg is empty when only the length of the checksum tells
+type sumCheck struct {
+	name string
+	sum  string
+	alg  string
+	src  string
+}
+
+type sumReport struct {
+	at   time.Time
+	rows []sumResult
+}
+
+type sumResult struct {
+	sumCheck
+	alg string
+	err error
+}
+
+type sumDB struct {
+	entr    map[string]fileSums
+	reports map[string]sumReport
+	sync.Mutex
+}
+
+func newSumCache() *sumDB {
+	db := new(sumDB)
+	db.entr = make(map[string]fileSums)
+	db.reports = make(map[string]sumReport)
+	return db
+}
+
+func (db *sumDB) get(fp string, fi os.FileInfo) (map[string]string, bool) {
+	db.Lock()
+	defer db.Unlock()
+	s, ok := db.entr[fp]
+	if !ok || s.size != fi.Size() || !s.mtime.Equal(fi.ModTime()) {
+		return nil, false
+	}
+	return s.sums, true
+}
+
+func (db *sumDB) put(fp string, fi os.FileInfo, sums map[string]string) {
+	db.Lock()
+	defer db.Unlock()
+	for f, s := range db.entr {
+		if time.Since(s.at) > 24*time.Hour {
+			delete(db.entr, f)
+		}
+	}
+	db.entr[fp] = fileSums{size: fi.Size(), mtime: fi.ModTime(), at: time.Now(), sums: sums}
+}
+
+// hashFile returns checksums of fp, reading the file only if it's not cached
+func hashFile(ctx context.Context, j *job, fp string) (map[string]string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := sumCache.get(fp, fi); ok {
+		j.progress(fi.Size(), 1)
+		return s, nil
+	}
+	b2, _ := blake2b.New512(nil)
+	hs := []hash.Hash{md5.New(), sha1.New(), sha256.New(), sha512.New(), b2}
+	ws := make([]io.Writer, len(hs))
+	for i, h := range hs {
+		ws[i] = h
+	}
+	_, err = io.Copy(io.MultiWriter(ws...), &jobReader{ctx: ctx, j: j, r: f})
+	if err != nil {
+		return nil, err
+	}
+	j.progress(0, 1)
+	s := make(map[string]string)
+	for i, h := range hs {
+		s[sumAlgs[i]] = hex.EncodeToString(h.Sum(nil))
+	}
+	sumCache.put(fp, fi, s)
+	return s, nil
+}
+
+// sumsFor returns expected checksums of file name found in checksum files in dir
+func sumsFor(dir, name string) []sumCheck {
+	l := []sumCheck{}
+	for _, c := range dirSums(dir) {
+		if c.name == name {
+			l = append(l, c)
+		}
+	}
+	return l
+}
+
+// dirSums reads all checksum files in dir, both SHA256SUMS style lists and
+// single file sidecars like name.iso.sha256
+func dirSums(dir string) []sumCheck {
+	l := []sumCheck{}
+	d, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return l
+	}
+	for _, f := range d {
+		if !f.Mode().IsRegular() || f.Size() > 1<<20 || deniedPfx(dir+"/"+f.Name()) {
+			continue
+		}
+		own, alg := "", ""
+		for e, a := range sumExts {
+			if strings.HasSuffix(strings.ToLower(f.Name()), e) {
+				own = f.Name()[:len(f.Name())-len(e)]
+				alg = a
+			}
+		}
+		list := false
+		for n, a := range sumFiles {
+			if strings.EqualFold(f.Name(), n) {
+				list = true
+				alg = a
+			}
+		}
+		if own == "" && !list {
+			continue
+		}
+		for _, c := range parseSums(dir+"/"+f.Name(), own, alg) {
+			// entries for files in other directories are not verified
+			if !strings.Contains(c.name, "/") {
+				l = append(l, c)
+			}
+		}
+	}
+	return l
+}
+
+// parseSums parses a checksum file, lines without a file name are taken as checksums of own,
+// alg is the algorithm told by the file name, BSD style tags take precedence
+func parseSums(fp, own, alg string) []sumCheck {
+	l := []sumCheck{}
+	f, err := os.Open(fp)
+	if err != nil {
+		return l
+	}
+	defer f.Close()
+	src := filepath.Base(fp)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		ln := strings.TrimSpace(s.Text())
+		if m := sumBsd.FindStringSubmatch(ln); m != nil {
+			l = append(l, sumCheck{name: strings.TrimPrefix(m[2], "./"), sum: strings.ToLower(m[3]), alg: sumTag(m[1]), src: src})
+			continue
+		}
+		if m := sumGnu.FindStringSubmatch(ln); m != nil {
+			l = append(l, sumCheck{name: strings.TrimPrefix(m[2], "./"), sum: strings.ToLower(m[1]), alg: alg, src: src})
+			continue
+		}
+		if _, ok := sumLen[len(ln)]; ok && own != "" && sumHex.MatchString(ln) {
+			l = append(l, sumCheck{name: own, sum: strings.ToLower(ln), alg: alg, src: src})
+		}
+	}
+	return l
+}
+
+// sumTag returns algorithm name of a BSD style tag, unknown tags are returned as they are
+func sumTag(t string) string {
+	if a, ok := sumTags[t]; ok {
+		return a
+	}
+	return t
+}
+
+// checkSum compares expected checksum with computed ones of alg and returns algorithm name,
+// without alg it's told by length, 128 digits may be either SHA-512 or BLAKE2b-512
+func checkSum(sums map[string]string, exp, alg string) (string, error) {
+	exp = strings.ToLower(exp)
+	cand := []string{alg}
+	if alg == "" {
+		cand = sumLen[len(exp)]
+		if len(cand) == 0 {
+			return "", fmt.Errorf("unknown checksum type")
+		}
+	}
+	for _, a := range cand {
+		s, ok := sums[a]
+		if !ok {
+			return a, fmt.Errorf("unsupported algorithm")
+		}
+		if len(s) != len(exp) {
+			return a, fmt.Errorf("wrong length for %v", a)
+		}
+		if s == exp {
+			return a, nil
+		}
+	}
+	return strings.Join(cand, " or "), fmt.Errorf("mismatch")
+}
+
+// showSums computes checksums of uFp in a job and shows them with verification
+// against checksum files and pasted text
+func showSums(w http.ResponseWriter, uFp, uExpect, eSort, user string) {
+	if deniedPfx(uFp) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	fi, err := os.Stat(uFp)
+	if err != nil {
+		htErr(w, "checksum", err)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		htErr(w, "checksum", fmt.Errorf("not a regular file"))
+		return
+	}
+	uDir := filepath.Dir(uFp)
+	sums, ok := sumCache.get(uFp, fi)
+	if !ok {
+		j := jobs.start(user, "checksum "+uFp, func(ctx context.Context, j *job) error {
+			j.setTotal(fi.Size())
+			_, err := hashFile(ctx, j, uFp)
+			return err
+		})
+		jobRedirect(w, j, *wfmPfx+"?fn=sum&fp="+url.QueryEscape(uFp)+"&sort="+eSort, uDir, eSort)
+		return
+	}
+
+	header(w, uDir, eSort)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD COLSPAN="2" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Checksums of ` + html.EscapeString(uFp) + `</FONT></TD></TR>
+    `))
+	for n, a := range sumAlgs {
+		fmt.Fprintf(w, `<TR BGCOLOR="%v"><TD NOWRAP>%v&nbsp;</TD><TD><TT>%v</TT></TD></TR>`+"\n", rowColor(n, false), a, sums[a])
+	}
+	w.Write([]byte(`<TR><TD COLSPAN="2">&nbsp;</TD></TR>`))
+	for _, c := range sumsFor(uDir, fi.Name()) {
+		alg, err := checkSum(sums, c.sum, c.alg)
+		fmt.Fprintf(w, `<TR><TD NOWRAP>%v&nbsp;</TD><TD>%v %v</TD></TR>`+"\n", html.EscapeString(c.src), alg, sumStatus(err))
+	}
+	if uExpect != "" {
+		ex := pastedSums(uExpect)
+		if len(ex) == 0 {
+			fmt.Fprintf(w, `<TR><TD NOWRAP>pasted&nbsp;</TD><TD>%v</TD></TR>`+"\n", sumStatus(fmt.Errorf("no checksum found in the text")))
+		}
+		for _, e := range ex {
+			alg, err := checkSum(sums, e.sum, e.alg)
+			fmt.Fprintf(w, `<TR><TD NOWRAP>pasted&nbsp;</TD><TD>%v <TT>%v</TT> %v</TD></TR>`+"\n", alg, html.EscapeString(e.sum), sumStatus(err))
+		}
+	}
+	w.Write([]byte(`
+    </TABLE><P>
+    &nbsp;Verify against checksum:<BR>
+    &nbsp;<TEXTAREA NAME="expect" COLS="80" ROWS="2"></TEXTAREA><P>
+    &nbsp;<INPUT TYPE="SUBMIT" VALUE=" Verify " NAME="verify">
+    <INPUT TYPE="SUBMIT" VALUE=" OK " NAME="cancel">
+    <INPUT TYPE="HIDDEN" NAME="fn" VALUE="sum">
+    <INPUT TYPE="HIDDEN" NAME="fp" VALUE="` + html.EscapeString(uFp) + `">
+    <P>&nbsp;<A HREF="` + *wfmPfx + `?fn=sumall&amp;dir=` + url.QueryEscape(uDir) + `&amp;sort=` + html.EscapeString(eSort) + `">Verify all files in this folder against checksum files</A>
+    `))
+	footer(w)
+}
+
+// pastedSums finds checksums in pasted text, BSD style lines keep their algorithm
+func pastedSums(t string) []sumCheck {
+	l := []sumCheck{}
+	for _, ln := range strings.Split(t, "\n") {
+		ln = strings.TrimSpace(ln)
+		if m := sumBsd.FindStringSubmatch(ln); m != nil {
+			l = append(l, sumCheck{sum: m[3], alg: sumTag(m[1])})
+			continue
+		}
+		for _, e := range sumHex.FindAllString(ln, -1) {
+			l = append(l, sumCheck{sum: e})
+		}
+	}
+	return l
+}
+
+func sumStatus(err error) string {
+	if err != nil {
+		return `<FONT COLOR="#CC0000"><B>` + html.EscapeString(err.Error()) + `</B></FONT>`
+	}
+	return `<FONT COLOR="#008000"><B>OK</B></FONT>`
+}
+
+// verifyAll checks all files listed in checksum files of uDir in a job
+func verifyAll(w http.ResponseWriter, uDir, eSort, user string) {
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	cl := dirSums(uDir)
+	if len(cl) == 0 {
+		htErr(w, "verify", fmt.Errorf("no checksum files found in %v", uDir))
+		return
+	}
+	j := jobs.start(user, "verify checksums in "+uDir, func(ctx context.Context, j *job) error {
+		for _, c := range cl {
+			fi, err := os.Stat(uDir + "/" + c.name)
+			if err == nil {
+				j.addTotal(fi.Size())
+			}
+		}
+		r := sumReport{at: time.Now()}
+		bad := 0
+		for _, c := range cl {
+			fp := uDir + "/" + c.name
+			res := sumResult{sumCheck: c}
+			err := fmt.Errorf("forbidden")
+			if !deniedPfx(fp) {
+				var sums map[string]string
+				sums, err = hashFile(ctx, j, fp)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if err == nil {
+					res.alg, err = checkSum(sums, c.sum, c.alg)
+				}
+			}
+			if err != nil {
+				res.err = err
+				bad++
+			}
+			r.rows = append(r.rows, res)
+		}
+		sumCache.Lock()
+		sumCache.reports[uDir] = r
+		sumCache.Unlock()
+		j.Lock()
+		j.Result = fmt.Sprintf("%d ok, %d failed", len(cl)-bad, bad)
+		j.Unlock()
+		return nil
+	})
+	jobRedirect(w, j, *wfmPfx+"?fn=sumreport&dir="+url.QueryEscape(uDir)+"&sort="+eSort, uDir, eSort)
+}
+
+func sumReportPage(w http.ResponseWriter, uDir, eSort string) {
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	sumCache.Lock()
+	r, ok := sumCache.reports[uDir]
+	sumCache.Unlock()
+	if !ok {
+		htErr(w, "verify", fmt.Errorf("no verification report for %v", uDir))
+		return
+	}
+	header(w, uDir, eSort)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD COLSPAN="4" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Checksum verification of ` + html.EscapeString(uDir) + ` ` + r.at.Format(time.Stamp) + `</FONT></TD></TR>
+    <TR BGCOLOR="#A0A0A0">
+    <TD NOWRAP><FONT COLOR="#FFFFFF">File</FONT></TD>
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Checksum file</FONT></TD>
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Type</FONT></TD>
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Status</FONT></TD>
+    </TR>
+    `))
+	for n, c := range r.rows {
+		fmt.Fprintf(w, `<TR BGCOLOR="%v"><TD>%v</TD><TD>%v</TD><TD NOWRAP>%v</TD><TD NOWRAP>%v</TD></TR>`+"\n",
+			rowColor(n, false), html.EscapeString(c.name), html.EscapeString(c.src), c.alg, sumStatus(c.err))
+	}
+	w.Write([]byte(`
+    </TABLE><P>
+    &nbsp;<INPUT TYPE="SUBMIT" VALUE=" OK " NAME="OK">
+    `))
+	footer(w)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func copyFiles(w http.ResponseWriter, uDir string, uFiles []string, uDst, policy, eSort, user string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	uDst = cleanDir(uDst)
+	if deniedPfx(uDir) || deniedPfx(uDst) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	if len(uFiles) == 0 {
+		htErr(w, "copy", fmt.Errorf("no files selected"))
+		return
+	}
+	switch policy {
+	case "skip", "overwrite", "rename":
+	default:
+		policy = "skip"
+	}
+	lF := ""
+	for _, f := range uFiles {
+		lF = filepath.Base(f)
+		if strings.HasPrefix(uDst+"/", filepath.Clean(uDir+"/"+lF)+"/") {
+			htErr(w, "copy", fmt.Errorf("can not copy %v in to itself", lF))
+			return
+		}
+	}
+
+	j := jobs.start(user, fmt.Sprintf("copy %v from %v to %v", strings.Join(uFiles, ", "), uDir, uDst), func(ctx context.Context, j *job) error {
+		var t int64
+		for _, f := range uFiles {
+			t += treeSize(ctx, filepath.Clean(uDir+"/"+filepath.Base(f)))
+		}
+		j.setTotal(t)
+		for _, f := range uFiles {
+			b := filepath.Base(f)
+			err := copyTree(ctx, j, filepath.Clean(uDir+"/"+b), filepath.Clean(uDst+"/"+b), policy, true)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	jobRedirect(w, j, *wfmPfx+"?dir="+url.QueryEscape(uDst)+"&sort="+eSort+"&hi="+url.QueryEscape(lF), uDir, eSort)
+}
+
+// copyTree recursively copies src to dst preserving permissions, times, ownership
+// where possible and symlinks, existing files are skipped, overwritten or the copy
+// is renamed according to policy, existing directories are merged
+func copyTree(ctx context.Context, j *job, src, dst, policy string, top bool) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	// dst is checked by callers, internal moves may target hidden directories
+	if deniedPfx(src) {
+		return nil
+	}
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	di, err := os.Lstat(dst)
+	if err == nil && !(fi.IsDir() && di.IsDir() && !(top && policy == "rename")) {
+		switch policy {
+		case "skip":
+			return nil
+		case "rename":
+			dst = uniqName(dst)
+		case "overwrite":
+			if fi.Mode().IsRegular() && di.Mode().IsRegular() {
+				break
+			}
+			// replacing with something of a different type, keep the old one in trash
+			if *hardDelete {
+				err = os.RemoveAll(dst)
+			} else {
+				err = trashFile(ctx, j, dst)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		t, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(t, dst)
+		if err != nil {
+			return err
+		}
+		copyOwner(dst, fi)
+		j.progress(0, 1)
+		return nil
+
+	case fi.IsDir():
+		err = os.Mkdir(dst, 0700)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		d, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, f := range d {
+			err = copyTree(ctx, j, src+"/"+f.Name(), dst+"/"+f.Name(), policy, false)
+			if err != nil {
+				return err
+			}
+		}
+		copyOwner(dst, fi)
+		err = os.Chmod(dst, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if err != nil {
+			return err
+		}
+		j.progress(0, 1)
+		return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+
+	case fi.Mode().IsRegular():
+		return copyFile(ctx, j, src, dst, fi)
+	}
+
+	log.Printf("copy: skipping special file %v", src)
+	return nil
+}
+
+// copyFile copies to a temp file next to dst and renames it in to place once complete
+func copyFile(ctx context.Context, j *job, src, dst string, fi os.FileInfo) error {
+	i, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer i.Close()
+	o, err := os.CreateTemp(filepath.Dir(dst), ".wfm-copy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(o.Name())
+	defer o.Close()
+	_, err = io.Copy(o, &jobReader{ctx: ctx, j: j, r: i})
+	if err != nil {
+		return err
+	}
+	copyOwner(o.Name(), fi)
+	err = o.Chmod(fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+	if err != nil {
+		return err
+	}
+	err = o.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(o.Name(), fi.ModTime(), fi.ModTime())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(o.Name(), dst)
+	if err != nil {
+		return err
+	}
+	j.progress(0, 1)
+	return nil
+}
+
+// copyOwner sets uid/gid of fp to that of fi, only works when running as root
+func copyOwner(fp string, fi os.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || os.Geteuid() != 0 {
+		return
+	}
+	os.Lchown(fp, int(st.Uid), int(st.Gid))
+}
+
+// uniqName returns first "name (N).ext" that doesn't exist
+func uniqName(fp string) string {
+	for i := 1; ; i++ {
+		n := numberedName(fp, i)
+		_, err := os.Lstat(n)
+		if err != nil {
+			return n
+		}
+	}
+}
+
+// movePath renames src to dst, across filesystems it copies src to a temporary
+// directory next to dst, verifies the copy and only then moves it in to place
+// and removes src, so a failure never leaves source deleted without destination
+func movePath(ctx context.Context, j *job, src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	log.Printf("move: %v and %v are on different filesystems, copying", src, dst)
+	// copyTree skips denied paths, they would be lost when src is removed
+	if hasDenied(ctx, src) {
+		return fmt.Errorf("can not move %v to another filesystem, it contains denied paths", src)
+	}
+	j.addTotal(treeSize(ctx, src))
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), ".wfm-move-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	t := tmp + "/" + filepath.Base(dst)
+	err = copyTree(ctx, j, src, t, "overwrite", true)
+	if err != nil {
+		return err
+	}
+	err = verifyTree(ctx, src, t)
+	if err != nil {
+		return fmt.Errorf("verify copy of %v failed, source kept: %v", src, err)
+	}
+	err = os.Rename(t, dst)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// hasDenied tells if there are any denied paths under src
+func hasDenied(ctx context.Context, src string) bool {
+	d := false
+	filepath.Walk(src, func(p string, _ os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if deniedPfx(p) {
+			d = true
+			return io.EOF
+		}
+		return nil
+	})
+	return d
+}
+
+// verifyTree checks that dst has the same structure, symlinks and file contents as src
+func verifyTree(ctx context.Context, src, dst string) error {
+	return filepath.Walk(src, func(p string, si os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		d := dst + strings.TrimPrefix(p, src)
+		di, err := os.Lstat(d)
+		if err != nil {
+			return err
+		}
+		if si.Mode().Type() != di.Mode().Type() {
+			return fmt.Errorf("%v: type mismatch", d)
+		}
+		switch {
+		case si.Mode()&os.ModeSymlink != 0:
+			st, _ := os.Readlink(p)
+			dt, _ := os.Readlink(d)
+			if st != dt {
+				return fmt.Errorf("%v: link target mismatch", d)
+			}
+		case si.Mode().IsRegular():
+			if si.Size() != di.Size() {
+				return fmt.Errorf("%v: size mismatch", d)
+			}
+			sh, err := fileHash(p)
+			if err != nil {
+				return err
+			}
+			dh, err := fileHash(d)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(sh, dh) {
+				return fmt.Errorf("%v: content mismatch", d)
+			}
+		}
+		return nil
+	})
+}
+
+func fileHash(fp string) ([]byte, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// sameFs returns true if a and b are on the same filesystem
+func sameFs(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	as, ok := ai.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	bs, ok := bi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	return as.Dev == bs.Dev
+}
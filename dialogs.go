@@ -5,9 +5,11 @@ import (
 	"html"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/dustin/go-humanize"
 )
@@ -41,6 +43,25 @@ func prompt(w http.ResponseWriter, uDir, uBaseName, sort, action string, mulName
         &nbsp;<BR>Destination URL:<P>
         <INPUT TYPE="TEXT" NAME="url" SIZE="40" VALUE="">
         `))
+	case "mksymlink":
+		w.Write([]byte(`
+        &nbsp;<BR>Enter name for the new symbolic link:<P>
+        <INPUT TYPE="TEXT" NAME="file" SIZE="40" VALUE="">
+        &nbsp;<BR>Target path, absolute or relative to this folder:<P>
+        <INPUT TYPE="TEXT" NAME="target" SIZE="40" VALUE="">
+        `))
+	case "retarget":
+		eBn := html.EscapeString(uBaseName)
+		if deniedPfx(uDir + "/" + uBaseName) {
+			fmt.Fprintln(w, "&nbsp;<BR>forbidden<P>")
+			break
+		}
+		t, _ := os.Readlink(uDir + "/" + uBaseName)
+		w.Write([]byte(`
+        &nbsp;<BR>Enter new target for the symbolic link <B>` + eBn + `</B>:<P>
+        <INPUT TYPE="TEXT" NAME="target" SIZE="40" VALUE="` + html.EscapeString(t) + `">
+        <INPUT TYPE="HIDDEN" NAME="file" VALUE="` + eBn + `">
+        `))
 	case "rename":
 		eBn := html.EscapeString(uBaseName)
 		w.Write([]byte(`
@@ -56,6 +77,25 @@ func prompt(w http.ResponseWriter, uDir, uBaseName, sort, action string, mulName
 		` + upDnDir(uDir, "") + `</SELECT>
 		<INPUT TYPE="HIDDEN" NAME="file" VALUE="` + eBn + `">
 		`))
+	case "copy":
+		eBn := html.EscapeString(uBaseName)
+		w.Write([]byte(`
+		&nbsp;<BR>Select destination folder for copy of <B>` + eBn + `</B>:<P>
+		<SELECT NAME="dst">
+		` + cpDir(uDir) + `</SELECT><P>
+		` + cpPolicy() + `
+		<INPUT TYPE="HIDDEN" NAME="file" VALUE="` + eBn + `">
+		`))
+	case "extract":
+		eBn := html.EscapeString(uBaseName)
+		w.Write([]byte(`
+		&nbsp;<BR>Extract <B>` + eBn + `</B> to:<P>
+		<SELECT NAME="dst">
+		` + cpDir(uDir) + `</SELECT><P>
+		<INPUT TYPE="CHECKBOX" NAME="sub" VALUE="1" CHECKED> in to a new folder <B>` + html.EscapeString(arcBase(uBaseName)) + `</B><P>
+		` + cpPolicy() + `
+		<INPUT TYPE="HIDDEN" NAME="file" VALUE="` + eBn + `">
+		`))
 	case "delete":
 		var a string
 		fi, _ := os.Stat(uDir + "/" + uBaseName)
@@ -66,12 +106,109 @@ func prompt(w http.ResponseWriter, uDir, uBaseName, sort, action string, mulName
 		}
 		eBn := html.EscapeString(uBaseName)
 		w.Write([]byte(`
-        &nbsp;<BR>Are you sure you want to delete:<BR><B>` + eBn + `</B>
+        &nbsp;<BR>Are you sure you want to ` + delVerb() + `:<BR><B>` + eBn + `</B>
         (` + a + `)<P>
         <INPUT TYPE="HIDDEN" NAME="file" VALUE="` + eBn + `">
         `))
 	case "multi_delete":
-		fmt.Fprintf(w, "&nbsp;<BR>Are you sure you want to delete from <B>%v</B>:<P><UL>\n", html.EscapeString(uDir))
+		fmt.Fprintf(w, "&nbsp;<BR>Are you sure you want to %v from <B>%v</B>:<P><UL>\n", delVerb(), html.EscapeString(uDir))
+		for _, f := range mulName {
+			fE := html.EscapeString(f)
+			fmt.Fprintf(w, "<INPUT TYPE=\"HIDDEN\" NAME=\"mulf\" VALUE=\"%s\">\n"+
+				"<LI TYPE=\"square\">%v</LI>\n", fE, fE)
+		}
+		fmt.Fprintln(w, "</UL><P>")
+	case "purge":
+		t, err := trashInfo(mulName[0], filepath.Base(uBaseName))
+		if err == nil && deniedPfx(t.Path) {
+			err = fmt.Errorf("forbidden")
+		}
+		if err != nil {
+			fmt.Fprintf(w, "&nbsp;<BR>%v<P>\n", html.EscapeString(err.Error()))
+			break
+		}
+		w.Write([]byte(`
+		&nbsp;<BR>Are you sure you want to permanently delete:<BR><B>` + html.EscapeString(t.Path) + `</B><P>
+		<INPUT TYPE="HIDDEN" NAME="file" VALUE="` + html.EscapeString(t.Name) + `">
+		<INPUT TYPE="HIDDEN" NAME="trash" VALUE="` + html.EscapeString(t.Dir) + `">
+		`))
+	case "restore_version":
+		eBn := html.EscapeString(uBaseName)
+		eV := html.EscapeString(mulName[0])
+		w.Write([]byte(`
+		&nbsp;<BR>Replace <B>` + eBn + `</B> with version ` + eV + `?<BR>
+		Current contents will be kept as a new version.<P>
+		<INPUT TYPE="HIDDEN" NAME="file" VALUE="` + eBn + `">
+		<INPUT TYPE="HIDDEN" NAME="v" VALUE="` + eV + `">
+		`))
+	case "empty_trash":
+		fmt.Fprintf(w, "&nbsp;<BR>Are you sure you want to permanently delete all %d items in trash?<P>\n", len(trashList(false)))
+	case "share":
+		eBn := html.EscapeString(uBaseName)
+		w.Write([]byte(`
+		&nbsp;<BR>Create public link for <B>` + eBn + `</B><P>
+		Expires after:<BR>
+		<SELECT NAME="expire">
+		<OPTION VALUE="1h">1 hour</OPTION>
+		<OPTION VALUE="24h">1 day</OPTION>
+		<OPTION VALUE="168h" SELECTED>7 days</OPTION>
+		<OPTION VALUE="720h">30 days</OPTION>
+		<OPTION VALUE="0">never</OPTION>
+		</SELECT><P>
+		Download limit (0 - unlimited):<BR>
+		<INPUT TYPE="TEXT" NAME="maxdown" SIZE="10" VALUE="0"><P>
+		Password (optional):<BR>
+		<INPUT TYPE="PASSWORD" NAME="password" SIZE="40" VALUE=""><P>
+		<INPUT TYPE="HIDDEN" NAME="file" VALUE="` + eBn + `">
+		`))
+		fi, err := os.Stat(uDir + "/" + uBaseName)
+		if err == nil && fi.IsDir() {
+			w.Write([]byte(`
+			<INPUT TYPE="RADIO" NAME="type" VALUE="" CHECKED> Download link<BR>
+			<INPUT TYPE="RADIO" NAME="type" VALUE="dropbox"> Upload only drop box, quota:
+			<INPUT TYPE="TEXT" NAME="quota" SIZE="10" VALUE="1 GB">
+			`))
+		}
+	case "download":
+		eBn := html.EscapeString(uBaseName)
+		w.Write([]byte(`
+		&nbsp;<BR>Download <B>` + eBn + `</B> as:<P>
+		` + arcFormats() + `
+		<INPUT TYPE="HIDDEN" NAME="file" VALUE="` + eBn + `">
+		`))
+	case "multi_download":
+		fmt.Fprintf(w, "&nbsp;<BR>Download from <B>%v</B> as: %v<P>\n<UL>Items:<P>\n",
+			html.EscapeString(uDir),
+			arcFormats(),
+		)
+		for _, f := range mulName {
+			fE := html.EscapeString(f)
+			fmt.Fprintf(w, "<INPUT TYPE=\"HIDDEN\" NAME=\"mulf\" VALUE=\"%s\">\n"+
+				"<LI TYPE=\"square\">%v</LI>\n", fE, fE)
+		}
+		fmt.Fprintln(w, "</UL><P>")
+	case "multi_compress":
+		opt7z := ""
+		if have7z() {
+			opt7z = "<OPTION VALUE=\"7z\">7z</OPTION>\n"
+		}
+		fmt.Fprintf(w, "&nbsp;<BR>Compress from: <B>%v</B><P>\n"+
+			"Archive name: <INPUT TYPE=\"TEXT\" NAME=\"file\" SIZE=\"30\" VALUE=\"%v\"><P>\n"+
+			"Format: <SELECT NAME=\"format\">\n"+
+			"<OPTION VALUE=\"zip\">ZIP</OPTION>\n"+
+			"<OPTION VALUE=\"tar.gz\">tar.gz</OPTION>\n"+
+			"<OPTION VALUE=\"tar.xz\">tar.xz</OPTION>\n"+
+			"<OPTION VALUE=\"tar.zst\">tar.zst</OPTION>\n"+
+			"%v</SELECT><P>\n"+
+			"Compression: <INPUT TYPE=\"RADIO\" NAME=\"level\" VALUE=\"fast\"> Fast\n"+
+			"<INPUT TYPE=\"RADIO\" NAME=\"level\" VALUE=\"normal\" CHECKED> Normal\n"+
+			"<INPUT TYPE=\"RADIO\" NAME=\"level\" VALUE=\"best\"> Best<P>\n"+
+			"To: <SELECT NAME=\"dst\">%v</SELECT><P>\n<UL>Items:<P>\n",
+			html.EscapeString(uDir),
+			html.EscapeString(arcName(uDir, mulName)),
+			opt7z,
+			cpDir(uDir),
+		)
 		for _, f := range mulName {
 			fE := html.EscapeString(f)
 			fmt.Fprintf(w, "<INPUT TYPE=\"HIDDEN\" NAME=\"mulf\" VALUE=\"%s\">\n"+
@@ -90,6 +227,48 @@ func prompt(w http.ResponseWriter, uDir, uBaseName, sort, action string, mulName
 				"<LI TYPE=\"square\">%v</LI>\n", fE, fE)
 		}
 		fmt.Fprintln(w, "</UL><P>")
+	case "props", "info":
+		fp := uDir + "/" + uBaseName
+		propsInfo(w, fp)
+		fi, err := os.Lstat(fp)
+		if action == "props" && err == nil && !deniedPfx(fp) {
+			propsForm(w, fi)
+		}
+		fmt.Fprintf(w, "<INPUT TYPE=\"HIDDEN\" NAME=\"file\" VALUE=\"%v\">\n", html.EscapeString(uBaseName))
+	case "multi_props":
+		fmt.Fprintf(w, "&nbsp;<BR>Properties of items in: <B>%v</B><P>\n<UL>Items:<P>\n", html.EscapeString(uDir))
+		for _, f := range mulName {
+			fE := html.EscapeString(f)
+			fmt.Fprintf(w, "<INPUT TYPE=\"HIDDEN\" NAME=\"mulf\" VALUE=\"%s\">\n"+
+				"<LI TYPE=\"square\">%v</LI>\n", fE, fE)
+		}
+		fmt.Fprintln(w, "</UL><P>")
+		propsForm(w, nil)
+	case "multi_hardlink":
+		fmt.Fprintf(w, "&nbsp;<BR>Hard link from: <B>%v</B><P>\n"+
+			"To: <SELECT NAME=\"dst\">%v</SELECT><P>\n<UL>Files:<P>\n",
+			html.EscapeString(uDir),
+			cpDir(uDir),
+		)
+		for _, f := range mulName {
+			fE := html.EscapeString(f)
+			fmt.Fprintf(w, "<INPUT TYPE=\"HIDDEN\" NAME=\"mulf\" VALUE=\"%s\">\n"+
+				"<LI TYPE=\"square\">%v</LI>\n", fE, fE)
+		}
+		fmt.Fprintln(w, "</UL><P>")
+	case "multi_copy":
+		fmt.Fprintf(w, "&nbsp;<BR>Copy from: <B>%v</B><P>\n"+
+			"To: <SELECT NAME=\"dst\">%v</SELECT><P>\n%v<UL>Items:<P>\n",
+			html.EscapeString(uDir),
+			cpDir(uDir),
+			cpPolicy(),
+		)
+		for _, f := range mulName {
+			fE := html.EscapeString(f)
+			fmt.Fprintf(w, "<INPUT TYPE=\"HIDDEN\" NAME=\"mulf\" VALUE=\"%s\">\n"+
+				"<LI TYPE=\"square\">%v</LI>\n", fE, fE)
+		}
+		fmt.Fprintln(w, "</UL><P>")
 	}
 
 	w.Write([]byte(`
@@ -108,7 +287,39 @@ func prompt(w http.ResponseWriter, uDir, uBaseName, sort, action string, mulName
 	footer(w)
 }
 
-func editText(w http.ResponseWriter, uFilePath, sort string) {
+func arcFormats() string {
+	return `<SELECT NAME="format">
+		<OPTION VALUE="zip">ZIP</OPTION>
+		<OPTION VALUE="tar.gz">tar.gz</OPTION>
+		<OPTION VALUE="tar.zst">tar.zst</OPTION>
+		</SELECT>`
+}
+
+func delVerb() string {
+	if *hardDelete {
+		return "permanently delete"
+	}
+	return "move to trash"
+}
+
+// cpDir is upDnDir with the current folder selectable, for making duplicates
+func cpDir(uDir string) string {
+	return "<OPTION VALUE=\"" + html.EscapeString(uDir) + "\" SELECTED>. - this folder</OPTION>\n" + upDnDir(uDir, "")
+}
+
+func cpPolicy() string {
+	return `If the destination exists:<BR>
+		<INPUT TYPE="RADIO" NAME="policy" VALUE="skip"> Skip<BR>
+		<INPUT TYPE="RADIO" NAME="policy" VALUE="overwrite"> Overwrite<BR>
+		<INPUT TYPE="RADIO" NAME="policy" VALUE="rename" CHECKED> Keep both, rename copy<P>
+		`
+}
+
+func editText(w http.ResponseWriter, uFilePath, sort, user string) {
+	if deniedPfx(uFilePath) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
 	fi, err := os.Stat(uFilePath)
 	if err != nil {
 		htErr(w, "Unable to get file attributes", err)
@@ -123,12 +334,17 @@ func editText(w http.ResponseWriter, uFilePath, sort string) {
 		htErr(w, "Unable to read file", err)
 		return
 	}
+	lk := ""
+	l, ok := edLocks.take(uFilePath, user)
+	if ok {
+		lk = `<FONT COLOR="#CC0000">` + html.EscapeString(l.user) + ` opened this file for editing ` + humanize.Time(l.since) + `</FONT>&nbsp;`
+	}
 	header(w, filepath.Dir(uFilePath), sort)
 	w.Write([]byte(`
     <TABLE BGCOLOR="#EEEEEE" BORDER="0" CELLSPACING="0" CELLPADDING="5" STYLE="width: 100%; height: 100%;">
     <TR STYLE="height:1%;">
     <TD ALIGN="LEFT" VALIGN="MIDDLE" BGCOLOR="#CCCCCC">File Editor: ` + html.EscapeString(filepath.Base(uFilePath)) + `</TD>
-    <TD  BGCOLOR="#CCCCCC" ALIGN="RIGHT">&nbsp;</TD>
+    <TD  BGCOLOR="#CCCCCC" ALIGN="RIGHT">` + lk + historyLink(uFilePath, sort) + `&nbsp;</TD>
     </TR>
     <TR STYLE="height:99%;">
     <TD COLSPAN="2" ALIGN="CENTER" VALIGN="MIDDLE" STYLE="height:100%;">
@@ -136,8 +352,139 @@ func editText(w http.ResponseWriter, uFilePath, sort string) {
     <INPUT TYPE="SUBMIT" NAME="save" VALUE="Save" STYLE="float: left;">
 	<INPUT TYPE="SUBMIT" NAME="cancel" VALUE="Cancel" STYLE="float: left; margin-left: 10px">
     <INPUT TYPE="HIDDEN" NAME="fp" VALUE="` + html.EscapeString(uFilePath) + `">
+    <INPUT TYPE="HIDDEN" NAME="mtime" VALUE="` + fmt.Sprint(fi.ModTime().UnixNano()) + `">
+    <INPUT TYPE="HIDDEN" NAME="hash" VALUE="` + textHash(f) + `">
+    </TD></TR></TABLE>
+    `))
+	footer(w)
+}
+
+// editConflict is shown instead of saving when the file changed on disk since it was
+// opened in the editor, the user's text stays in the form so it can be merged and saved
+func editConflict(w http.ResponseWriter, uFilePath, sort, mine string, disk []byte, fi os.FileInfo) {
+	header(w, filepath.Dir(uFilePath), sort)
+	w.Write([]byte(`
+    <TABLE BGCOLOR="#EEEEEE" BORDER="0" CELLSPACING="0" CELLPADDING="5" STYLE="width: 100%;">
+    <TR>
+    <TD COLSPAN="2" ALIGN="LEFT" VALIGN="MIDDLE" BGCOLOR="#CCCCCC"><FONT COLOR="#CC0000">` + html.EscapeString(filepath.Base(uFilePath)) +
+		` was modified on disk ` + humanize.Time(fi.ModTime()) + ` while you were editing it</FONT></TD>
+    </TR>
+    <TR><TD WIDTH="50%">Your version:</TD><TD WIDTH="50%">Current file on disk:</TD></TR>
+    <TR>
+    <TD><TEXTAREA NAME="text" SPELLCHECK="false" COLS="60" ROWS="20" STYLE="width: 99%;">` + html.EscapeString(mine) + `</TEXTAREA></TD>
+    <TD><TEXTAREA READONLY SPELLCHECK="false" COLS="60" ROWS="20" STYLE="width: 99%;">` + html.EscapeString(string(disk)) + `</TEXTAREA></TD>
+    </TR>
+    <TR><TD COLSPAN="2">Changes from disk (-) to your version (+):<BR>
+    `))
+	dl, err := diffText(string(disk), strings.ReplaceAll(mine, "\r\n", "\n"))
+	if err != nil {
+		fmt.Fprintf(w, "%v<P>\n", html.EscapeString(err.Error()))
+	} else {
+		diffHtml(w, dl, 3)
+	}
+	w.Write([]byte(`
+    </TD></TR>
+    <TR><TD COLSPAN="2">
+    <INPUT TYPE="SUBMIT" NAME="save" VALUE="Save your version" STYLE="float: left;">
+	<INPUT TYPE="SUBMIT" NAME="cancel" VALUE="Cancel" STYLE="float: left; margin-left: 10px">
+    <INPUT TYPE="HIDDEN" NAME="fp" VALUE="` + html.EscapeString(uFilePath) + `">
+    <INPUT TYPE="HIDDEN" NAME="mtime" VALUE="` + fmt.Sprint(fi.ModTime().UnixNano()) + `">
+    <INPUT TYPE="HIDDEN" NAME="hash" VALUE="` + textHash(disk) + `">
+    </TD></TR></TABLE>
+    `))
+	footer(w)
+}
+
+func historyLink(uFilePath, sort string) string {
+	if *versions == "off" {
+		return ""
+	}
+	return `<A HREF="` + *wfmPfx + `?fn=history&amp;fp=` + url.QueryEscape(uFilePath) + `&amp;sort=` + html.EscapeString(sort) + `">History</A>`
+}
+
+func uploadConflict(w http.ResponseWriter, uDir, sort, user string, up []upFile) {
+	header(w, uDir, sort)
+
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" HEIGHT="90%" BORDER="0" CELLSPACING="0" CELLPADDING="0"><TR><TD VALIGN="MIDDLE" ALIGN="CENTER">
+    <BR>&nbsp;<BR><P>
+    <TABLE WIDTH="400" BGCOLOR="#F0F0F0" BORDER="0" CELLSPACING="0" CELLPADDING="1" CLASS="tbr">
+      <TR><TD COLSPAN="2" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; upload_conflict</FONT></TD></TR>
+      <TR><TD WIDTH="30">&nbsp;</TD><TD>
+    `))
+
+	fmt.Fprintf(w, "&nbsp;<BR>The following files already exist in <B>%v</B>:<P><UL>\n", html.EscapeString(uDir))
+	n := 0
+	for _, u := range up {
+		if !u.keep {
+			if u.err == nil {
+				n++
+			}
+			continue
+		}
+		fmt.Fprintf(w, "<INPUT TYPE=\"HIDDEN\" NAME=\"upid\" VALUE=\"%s\">\n"+
+			"<LI TYPE=\"square\">%v (%v)</LI>\n", pendingUps.add(user, uDir, u), html.EscapeString(u.name), humanize.Bytes(uint64(u.size)))
+	}
+	fmt.Fprintln(w, "</UL>")
+	if n > 0 {
+		fmt.Fprintf(w, "%d other files were uploaded.<P>\n", n)
+	}
+	w.Write([]byte(`
+    <INPUT TYPE="RADIO" NAME="policy" VALUE="overwrite"> Overwrite<BR>
+    <INPUT TYPE="RADIO" NAME="policy" VALUE="rename" CHECKED> Keep both, rename uploaded<BR>
+    <INPUT TYPE="RADIO" NAME="policy" VALUE="backup"> Overwrite, keep backup of existing<BR>
+    <INPUT TYPE="RADIO" NAME="policy" VALUE="skip"> Skip<P>
+    </TD></TR>
+    <TR><TD COLSPAN="2">
+    <P><CENTER>
+    <INPUT TYPE="SUBMIT" VALUE=" OK " NAME="OK">&nbsp;
+    <INPUT TYPE="SUBMIT" VALUE=" Cancel " NAME="cancel">
+    <INPUT TYPE="HIDDEN" NAME="fn" VALUE="upload_conflict">
+    </CENTER>
+    </TD></TR><TR><TD COLSPAN="2">&nbsp;</TD></TR>
+    </TABLE>
     </TD></TR></TABLE>
     `))
+
+	footer(w)
+}
+
+func uploadSummary(w http.ResponseWriter, uDir, sort string, up []upFile) {
+	header(w, uDir, sort)
+
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" HEIGHT="90%" BORDER="0" CELLSPACING="0" CELLPADDING="0"><TR><TD VALIGN="MIDDLE" ALIGN="CENTER">
+    <BR>&nbsp;<BR><P>
+    <TABLE WIDTH="600" BGCOLOR="#F0F0F0" BORDER="0" CELLSPACING="0" CELLPADDING="1" CLASS="tbr">
+      <TR><TD COLSPAN="3" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Upload to ` + html.EscapeString(uDir) + `</FONT></TD></TR>
+    `))
+
+	var ok int
+	var total uint64
+	for _, u := range up {
+		r := "OK"
+		if u.err != nil {
+			r = `<FONT COLOR="#CC0000">` + html.EscapeString(u.err.Error()) + `</FONT>`
+		} else {
+			ok++
+			total += uint64(u.size)
+		}
+		fmt.Fprintf(w, "<TR><TD NOWRAP>&nbsp;%v</TD><TD NOWRAP ALIGN=\"right\">%v</TD><TD>&nbsp;%v</TD></TR>\n",
+			html.EscapeString(u.name), humanize.Bytes(uint64(u.size)), r)
+	}
+	fmt.Fprintf(w, "<TR><TD COLSPAN=\"3\"><P>&nbsp;Uploaded %d of %d files, %v</TD></TR>\n",
+		ok, len(up), humanize.Bytes(total))
+
+	w.Write([]byte(`
+    <TR><TD COLSPAN="3">
+    <P><CENTER>
+    <INPUT TYPE="SUBMIT" VALUE=" OK " NAME="OK">&nbsp;
+    </CENTER>
+    </TD></TR><TR><TD COLSPAN="3">&nbsp;</TD></TR>
+    </TABLE>
+    </TD></TR></TABLE>
+    `))
+
 	footer(w)
 }
 
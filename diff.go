@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+const diffMaxD = 2000
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// lineDiff returns the edit script turning a in to b using Myers' O(ND) algorithm,
+// only the changed middle part is diffed after trimming common prefix and suffix
+func lineDiff(a, b []string) ([]diffLine, error) {
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		p++
+	}
+	s := 0
+	for s < len(a)-p && s < len(b)-p && a[len(a)-1-s] == b[len(b)-1-s] {
+		s++
+	}
+	ma, mb := a[p:len(a)-s], b[p:len(b)-s]
+	n, m := len(ma), len(mb)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+	trace := [][]int{}
+loop:
+	for d := 0; d <= max; d++ {
+		if d > diffMaxD {
+			return nil, fmt.Errorf("too many differences")
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && ma[x] == mb[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+				break loop
+			}
+		}
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+	}
+
+	// walk back through the trace, trace[d] holds diagonals -d..d
+	rev := []diffLine{}
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		pv := trace[d-1]
+		k := x - y
+		pk := k - 1
+		if k == -d || (k != d && pv[k-1+d-1] < pv[k+1+d-1]) {
+			pk = k + 1
+		}
+		px := pv[pk+d-1]
+		py := px - pk
+		for x > px && y > py {
+			rev = append(rev, diffLine{' ', ma[x-1]})
+			x--
+			y--
+		}
+		if x == px {
+			rev = append(rev, diffLine{'+', mb[y-1]})
+		} else {
+			rev = append(rev, diffLine{'-', ma[x-1]})
+		}
+		x, y = px, py
+	}
+	for x > 0 && y > 0 {
+		rev = append(rev, diffLine{' ', ma[x-1]})
+		x--
+		y--
+	}
+
+	dl := make([]diffLine, 0, p+len(rev)+s)
+	for _, l := range a[:p] {
+		dl = append(dl, diffLine{' ', l})
+	}
+	for i := len(rev) - 1; i >= 0; i-- {
+		dl = append(dl, rev[i])
+	}
+	for _, l := range a[len(a)-s:] {
+		dl = append(dl, diffLine{' ', l})
+	}
+	return dl, nil
+}
+
+// diffText splits texts in to lines and diffs them
+func diffText(a, b string) ([]diffLine, error) {
+	return lineDiff(strings.Split(a, "\n"), strings.Split(b, "\n"))
+}
+
+// diffHtml writes a colored unified diff showing ctx unchanged lines around changes
+func diffHtml(w io.Writer, dl []diffLine, ctx int) {
+	show := make([]bool, len(dl))
+	for i, l := range dl {
+		if l.op == ' ' {
+			continue
+		}
+		for j := i - ctx; j <= i+ctx; j++ {
+			if j >= 0 && j < len(dl) {
+				show[j] = true
+			}
+		}
+	}
+	fmt.Fprintln(w, `<PRE STYLE="margin:0px">`)
+	gap := false
+	changed := false
+	for i, l := range dl {
+		if !show[i] {
+			gap = true
+			continue
+		}
+		if gap {
+			fmt.Fprintln(w, `<FONT COLOR="#808080">...</FONT>`)
+			gap = false
+		}
+		t := html.EscapeString(l.text)
+		switch l.op {
+		case '-':
+			fmt.Fprintf(w, `<SPAN STYLE="background-color:#FFCCCC">- %v</SPAN>`+"\n", t)
+			changed = true
+		case '+':
+			fmt.Fprintf(w, `<SPAN STYLE="background-color:#CCFFCC">+ %v</SPAN>`+"\n", t)
+			changed = true
+		default:
+			fmt.Fprintf(w, "  %v\n", t)
+		}
+	}
+	if !changed {
+		fmt.Fprintln(w, "No differences.")
+	}
+	fmt.Fprintln(w, `</PRE>`)
+}
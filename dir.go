@@ -3,10 +3,12 @@ package main
 import (
 	"fmt"
 	"html"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -14,7 +16,9 @@ import (
 	"github.com/dustin/go-humanize"
 )
 
-func listFiles(w http.ResponseWriter, uDir, sort, hi, user string, modern bool) {
+// listFiles writes the directory listing, sort is the escaped view state which
+// may also carry a filter, all preselects all listed entries for multi file operations
+func listFiles(w http.ResponseWriter, uDir, sort, hi, user string, modern, all bool) {
 	if deniedPfx(uDir) {
 		htErr(w, "access", fmt.Errorf("forbidden"))
 		return
@@ -25,12 +29,18 @@ func listFiles(w http.ResponseWriter, uDir, sort, hi, user string, modern bool)
 		htErr(w, "Unable to read directory", err)
 		return
 	}
+	by, flt := splitView(sort)
 	sl := []string{}
-	sortFiles(d, &sl, sort)
+	sortFiles(d, &sl, by)
+	for n := 0; n < len(sl); n += 2 {
+		sl[n] = html.EscapeString(viewQuery(sl[n], flt))
+	}
+	if flt != "" {
+		d = filterFiles(d, flt)
+	}
 
 	header(w, uDir, sort)
-	toolbars(w, uDir, user, sl, i)
-	qeDir := url.QueryEscape(uDir)
+	toolbars(w, uDir, user, flt, sl, i, modern)
 
 	r := 0
 	var total uint64
@@ -40,46 +50,15 @@ func listFiles(w http.ResponseWriter, uDir, sort, hi, user string, modern bool)
 		if deniedPfx(uDir + "/" + f.Name()) {
 			continue
 		}
-		var ldir bool
-		var li string
-		if f.Mode()&os.ModeSymlink == os.ModeSymlink {
-			ls, err := os.Stat(uDir + "/" + f.Name())
-			if err != nil {
-				continue
-			}
-			ldir = ls.IsDir()
-			li = i["li"]
-		}
-		if !f.IsDir() && !ldir {
+		li, ldir, broken := linkInfo(uDir, f, i, sort)
+		if broken || (!f.IsDir() && !ldir) {
 			continue
 		}
 		if !*showDot && f.Name()[0:1] == "." {
 			continue
 		}
-		if f.Name() == hi {
-			w.Write([]byte(`<TR BGCOLOR="#33CC33">`))
-		} else if r%2 == 0 {
-			w.Write([]byte(`<TR BGCOLOR="#FFFFFF">`))
-		} else {
-			w.Write([]byte(`<TR BGCOLOR="#F0F0F0">`))
-		}
+		dirRow(w, uDir, f.Name(), f, li, rowColor(r, f.Name() == hi), sort, i, true, all)
 		r++
-		qeFile := url.QueryEscape(f.Name())
-		heFile := html.EscapeString(f.Name())
-		w.Write([]byte(`
-        <TD NOWRAP ALIGN="left">
-		<INPUT TYPE="CHECKBOX" NAME="mulf" VALUE="` + heFile + `">
-        <A HREF="` + *wfmPfx + `?dir=` + qeDir + `/` + qeFile + `&amp;sort=` + sort + `">` + i["di"] + heFile + `/</A>` + li + `
-		</TD>
-        <TD NOWRAP>&nbsp;</TD>
-        <TD NOWRAP ALIGN="right">(` + humanize.Time(f.ModTime()) + `) ` + f.ModTime().Format(time.Stamp) + `</TD>
-        <TD NOWRAP ALIGN="right">
-        <A HREF="` + *wfmPfx + `?fn=renp&amp;dir=` + qeDir + `&amp;oldf=` + qeFile + `&amp;sort=` + sort + `">` + i["re"] + `</A>&nbsp;
-        <A HREF="` + *wfmPfx + `?fn=movp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + sort + `">` + i["mv"] + `</A>&nbsp;
-        <A HREF="` + *wfmPfx + `?fn=delp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + sort + `">` + i["rm"] + `</A>&nbsp;
-		</TD>
-        </TR>
-        `))
 	}
 
 	// List Files
@@ -87,59 +66,154 @@ func listFiles(w http.ResponseWriter, uDir, sort, hi, user string, modern bool)
 		if deniedPfx(uDir + "/" + f.Name()) {
 			continue
 		}
-		var ldir bool
-		var li string
-		if f.Mode()&os.ModeSymlink == os.ModeSymlink {
-			ls, err := os.Stat(uDir + "/" + f.Name())
-			if err != nil {
-				continue
-			}
-			ldir = ls.IsDir()
-			li = i["li"]
-		}
+		li, ldir, broken := linkInfo(uDir, f, i, sort)
 		if f.IsDir() || ldir {
 			continue
 		}
 		if !*showDot && f.Name()[0:1] == "." {
 			continue
 		}
-		if f.Name() == hi {
-			w.Write([]byte(`<TR BGCOLOR="#33CC33">`))
-		} else if r%2 == 0 {
-			w.Write([]byte(`<TR BGCOLOR="#FFFFFF">`))
-		} else {
-			w.Write([]byte(`<TR BGCOLOR="#F0F0F0">`))
+		if broken {
+			brokenRow(w, uDir, f.Name(), f, li, rowColor(r, f.Name() == hi), sort, i, modern, true, all)
+			r++
+			continue
 		}
+		fileRow(w, uDir, f.Name(), f, li, rowColor(r, f.Name() == hi), sort, i, modern, true, all)
 		r++
-		qeFile := url.QueryEscape(f.Name())
-		heFile := html.EscapeString(f.Name())
-		w.Write([]byte(`
+		total = total + uint64(f.Size())
+	}
+
+	// Footer
+	w.Write([]byte(`<TR><TD></TD><TD ALIGN="right" STYLE="border-top:1px solid grey">Total ` +
+		humanize.Bytes(total) + `</TD><TD></TD><TD></TD></TR>
+		<TR><TD COLSPAN="4" ALIGN="right">` + fsInfo(uDir) + `</TD></TR></TABLE>`))
+	footer(w)
+}
+
+func rowColor(r int, hi bool) string {
+	switch {
+	case hi:
+		return "#33CC33"
+	case r%2 == 0:
+		return "#FFFFFF"
+	}
+	return "#F0F0F0"
+}
+
+// dirRow writes listing row for directory f located in uDir, displayed as uName,
+// sel adds a checkbox for multi select, checked if ck
+func dirRow(w io.Writer, uDir, uName string, f os.FileInfo, li, bg, sort string, i map[string]string, sel, ck bool) {
+	qeDir := url.QueryEscape(uDir)
+	qeFile := url.QueryEscape(f.Name())
+	sz := "&nbsp;"
+	if f.IsDir() {
+		sz = duCol(uDir+"/"+f.Name(), f)
+	}
+	w.Write([]byte(`<TR BGCOLOR="` + bg + `">
+        <TD NOWRAP ALIGN="left">
+		` + selBox(f.Name(), sel, ck) + `
+        <A HREF="` + *wfmPfx + `?dir=` + qeDir + `/` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["di"] + html.EscapeString(uName) + `/</A>` + li + `
+		</TD>
+        <TD NOWRAP ALIGN="right">` + sz + `</TD>
+        <TD NOWRAP ALIGN="right">(` + humanize.Time(f.ModTime()) + `) ` + f.ModTime().Format(time.Stamp) + `</TD>
+        <TD NOWRAP ALIGN="right">
+        <A HREF="` + *wfmPfx + `?fn=downp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["dn"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=sharep&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["sh"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=renp&amp;dir=` + qeDir + `&amp;oldf=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["re"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=movp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["mv"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=copyp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["cp"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=propp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["pr"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=delp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["rm"] + `</A>&nbsp;
+		</TD>
+        </TR>
+        `))
+}
+
+func fileRow(w io.Writer, uDir, uName string, f os.FileInfo, li, bg, sort string, i map[string]string, modern, sel, ck bool) {
+	qeDir := url.QueryEscape(uDir)
+	qeFile := url.QueryEscape(f.Name())
+	hs := ""
+	if hasVersions(uDir + "/" + f.Name()) {
+		hs = `<A HREF="` + *wfmPfx + `?fn=history&amp;fp=` + qeDir + "/" + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["hs"] + `</A>&nbsp;`
+	}
+	ex := ""
+	if isArchive(f.Name()) {
+		ex = `<A HREF="` + *wfmPfx + `?fn=extractp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["ex"] + `</A>&nbsp;`
+	}
+	w.Write([]byte(`<TR BGCOLOR="` + bg + `">
         <TD NOWRAP ALIGN="LEFT">
-		<INPUT TYPE="CHECKBOX" NAME="mulf" VALUE="` + heFile + `">
-        <A HREF="` + *wfmPfx + `?fn=disp&amp;fp=` + qeDir + "/" + qeFile + `">` + fileIcon(qeFile, modern) + ` ` + heFile + `</A>` + li + `
+		` + selBox(f.Name(), sel, ck) + `
+        <A HREF="` + *wfmPfx + `?fn=disp&amp;fp=` + qeDir + "/" + qeFile + `">` + fileIcon(qeFile, modern) + ` ` + html.EscapeString(uName) + `</A>` + li + `
 		</TD>
         <TD NOWRAP ALIGN="right">` + humanize.Bytes(uint64(f.Size())) + `</TD>
         <TD NOWRAP ALIGN="right">(` + humanize.Time(f.ModTime()) + `) ` + f.ModTime().Format(time.Stamp) + `</TD>
         <TD NOWRAP ALIGN="right">
         <A HREF="` + *wfmPfx + `?fn=down&amp;fp=` + qeDir + "/" + qeFile + `">` + i["dn"] + `</A>&nbsp;
-        <A HREF="` + *wfmPfx + `?fn=edit&amp;fp=` + qeDir + "/" + qeFile + `&amp;sort=` + sort + `">` + i["ed"] + `</A>&nbsp;
-        <A HREF="` + *wfmPfx + `?fn=renp&amp;dir=` + qeDir + `&amp;oldf=` + qeFile + `&amp;sort=` + sort + `">` + i["re"] + `</A>&nbsp;
-        <A HREF="` + *wfmPfx + `?fn=movp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + sort + `">` + i["mv"] + `</A>&nbsp;
-        <A HREF="` + *wfmPfx + `?fn=delp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + sort + `">` + i["rm"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=edit&amp;fp=` + qeDir + "/" + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["ed"] + `</A>&nbsp;
+        ` + hs + ex + `
+        <A HREF="` + *wfmPfx + `?fn=sharep&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["sh"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=renp&amp;dir=` + qeDir + `&amp;oldf=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["re"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=movp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["mv"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=copyp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["cp"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=sum&amp;fp=` + qeDir + "/" + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["ck"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=propp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["pr"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=delp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["rm"] + `</A>&nbsp;
         </TD>
         </TR>
         `))
-		total = total + uint64(f.Size())
+}
+
+// brokenRow writes listing row for a symlink with missing target
+func brokenRow(w io.Writer, uDir, uName string, f os.FileInfo, li, bg, sort string, i map[string]string, modern, sel, ck bool) {
+	qeDir := url.QueryEscape(uDir)
+	qeFile := url.QueryEscape(f.Name())
+	w.Write([]byte(`<TR BGCOLOR="` + bg + `">
+        <TD NOWRAP ALIGN="LEFT">
+		` + selBox(f.Name(), sel, ck) + `
+        ` + fileIcon(qeFile, modern) + ` ` + html.EscapeString(uName) + li + `
+		</TD>
+        <TD NOWRAP ALIGN="right">&nbsp;</TD>
+        <TD NOWRAP ALIGN="right">(` + humanize.Time(f.ModTime()) + `) ` + f.ModTime().Format(time.Stamp) + `</TD>
+        <TD NOWRAP ALIGN="right">
+        <A HREF="` + *wfmPfx + `?fn=retargetp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["ed"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=renp&amp;dir=` + qeDir + `&amp;oldf=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["re"] + `</A>&nbsp;
+        <A HREF="` + *wfmPfx + `?fn=delp&amp;dir=` + qeDir + `&amp;file=` + qeFile + `&amp;sort=` + html.EscapeString(sort) + `">` + i["rm"] + `</A>&nbsp;
+        </TD>
+        </TR>
+        `))
+}
+
+func selBox(name string, sel, ck bool) string {
+	if !sel {
+		return ""
+	}
+	c := ""
+	if ck {
+		c = " CHECKED"
 	}
+	return `<INPUT TYPE="CHECKBOX" NAME="mulf" VALUE="` + html.EscapeString(name) + `"` + c + `>`
+}
 
-	// Footer
-	w.Write([]byte(`<TR><TD></TD><TD ALIGN="right" STYLE="border-top:1px solid grey">Total ` +
-		humanize.Bytes(total) + `</TD><TD></TD><TD></TD></TR></TABLE>`))
-	footer(w)
+// filterFiles returns entries with names matching glob flt, case insensitive, "!" in front inverts the match
+func filterFiles(d []os.FileInfo, flt string) []os.FileInfo {
+	inv := strings.HasPrefix(flt, "!")
+	flt = strings.ToLower(strings.TrimPrefix(flt, "!"))
+	o := []os.FileInfo{}
+	for _, f := range d {
+		m, _ := filepath.Match(flt, strings.ToLower(f.Name()))
+		if m != inv {
+			o = append(o, f)
+		}
+	}
+	return o
 }
 
-func toolbars(w http.ResponseWriter, uDir, user string, sl []string, i map[string]string) {
+func toolbars(w http.ResponseWriter, uDir, user, flt string, sl []string, i map[string]string, modern bool) {
 	eDir := html.EscapeString(uDir)
+	folder := ""
+	if modern {
+		folder = `<INPUT TYPE="FILE" NAME="folder" MULTIPLE WEBKITDIRECTORY TITLE="Upload folder" CLASS="nb">&nbsp;`
+	}
 	// Topbar
 	w.Write([]byte(`
         <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0" STYLE="height:28px;"><TR>
@@ -147,6 +221,16 @@ func toolbars(w http.ResponseWriter, uDir, user string, sl []string, i map[strin
                 <FONT COLOR="#FFFFFF">&nbsp;` + i["tcd"] + eDir + `</FONT>
             </TD>
             <TD NOWRAP  BGCOLOR="#F1F1F1" VALIGN="MIDDLE" ALIGN="RIGHT" STYLE="color:#000000; white-space:nowrap">
+				<INPUT TYPE="TEXT" NAME="fltpat" SIZE="10" VALUE="` + html.EscapeString(strings.TrimPrefix(flt, "!")) + `">
+				<INPUT TYPE="CHECKBOX" NAME="finv" VALUE="1"` + invChecked(flt) + ` TITLE="Invert filter">
+				<INPUT TYPE="SUBMIT" NAME="filter" VALUE="` + i["tfl"] + `Filter" CLASS="nb">
+				<INPUT TYPE="TEXT" NAME="q" SIZE="10" VALUE="">
+				<INPUT TYPE="SUBMIT" NAME="search" VALUE="` + i["tse"] + `Search" CLASS="nb">
+				<A HREF="` + *wfmPfx + `?fn=shares&amp;dir=` + eDir + `&amp;sort=">` + i["tsh"] + `Shares</A>
+				` + duLink(eDir, i) + `
+				<A HREF="` + *wfmPfx + `?fn=dups&amp;dir=` + eDir + `&amp;sort=">` + i["tdp"] + `Duplicates</A>
+				<A HREF="` + *wfmPfx + `?fn=jobs&amp;dir=` + eDir + `&amp;sort=">` + i["tjo"] + `Jobs</A>
+				` + trashLink(eDir, i) + `
 				<A HREF="` + *wfmPfx + `?fn=logout">` + i["tid"] + user + `</A>
                 <A HREF="` + *wfmPfx + `?fn=about&amp;dir=` + eDir + `&amp;sort=">&nbsp;` + i["tve"] + ` v` + vers + `&nbsp;</A>
             </TD>
@@ -164,6 +248,9 @@ func toolbars(w http.ResponseWriter, uDir, user string, sl []string, i map[strin
         </TD>
         <TD NOWRAP  VALIGN="MIDDLE" ALIGN="CENTER">
             <INPUT TYPE="SUBMIT" NAME="refresh" VALUE="` + i["tre"] + `Refresh" CLASS="nb">
+        </TD>
+            <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER" >
+        <INPUT TYPE="SUBMIT" NAME="selall" VALUE="` + i["tsa"] + `Select All" CLASS="nb">
         </TD>
             <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER" >
         <INPUT TYPE="SUBMIT" NAME="mdelp" VALUE="` + i["trm"] + `Delete" CLASS="nb">
@@ -171,6 +258,18 @@ func toolbars(w http.ResponseWriter, uDir, user string, sl []string, i map[strin
         <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER">
             <INPUT TYPE="SUBMIT" NAME="mmovp" VALUE="` + i["tmv"] + `Move" CLASS="nb">
         </TD>
+        <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER">
+            <INPUT TYPE="SUBMIT" NAME="mcopyp" VALUE="` + i["tcp"] + `Copy" CLASS="nb">
+        </TD>
+        <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER">
+            <INPUT TYPE="SUBMIT" NAME="mpropp" VALUE="` + i["tpr"] + `Properties" CLASS="nb">
+        </TD>
+        <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER">
+            <INPUT TYPE="SUBMIT" NAME="mdownp" VALUE="` + i["tdn"] + `Download" CLASS="nb">
+        </TD>
+        <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER">
+            <INPUT TYPE="SUBMIT" NAME="mcompp" VALUE="` + i["tzp"] + `Compress" CLASS="nb">
+        </TD>
         <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER">
             <INPUT TYPE="SUBMIT" NAME="mkd" VALUE="` + i["tdi"] + `New Dir" CLASS="nb">
         </TD>
@@ -181,7 +280,14 @@ func toolbars(w http.ResponseWriter, uDir, user string, sl []string, i map[strin
             <INPUT TYPE="SUBMIT" NAME="mkb" VALUE="` + i["tln"] + `New Link" CLASS="nb">
         </TD>
         <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER">
-            <INPUT TYPE="FILE" NAME="filename" CLASS="nb">&nbsp;
+            <INPUT TYPE="SUBMIT" NAME="mksl" VALUE="` + i["tsl"] + `New Symlink" CLASS="nb">
+        </TD>
+        <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER">
+            <INPUT TYPE="SUBMIT" NAME="mhlinkp" VALUE="` + i["thl"] + `Hard Link" CLASS="nb">
+        </TD>
+        <TD NOWRAP VALIGN="MIDDLE" ALIGN="CENTER">
+            <INPUT TYPE="FILE" NAME="filename" MULTIPLE CLASS="nb">&nbsp;
+            ` + folder + `
             <INPUT TYPE="SUBMIT" NAME="upload" VALUE="` + i["tul"] + `Upload" CLASS="nb">
         </TD>
         </TR></TABLE>
@@ -253,6 +359,46 @@ func sortFiles(f []os.FileInfo, l *[]string, by string) {
 	}
 }
 
+// setFilter reloads the listing with filter glob in the flt parameter,
+// names without wildcards are matched as substrings
+func setFilter(w http.ResponseWriter, uDir, uSort, uFlt string, inv bool) {
+	if uFlt != "" {
+		if !strings.ContainsAny(uFlt, "*?[") {
+			uFlt = "*" + uFlt + "*"
+		}
+		_, err := filepath.Match(uFlt, "")
+		if err != nil {
+			htErr(w, "filter", fmt.Errorf("invalid pattern %q", uFlt))
+			return
+		}
+		if inv {
+			uFlt = "!" + uFlt
+		}
+	}
+	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+viewQuery(uSort, uFlt))
+}
+
+func invChecked(flt string) string {
+	if strings.HasPrefix(flt, "!") {
+		return " CHECKED"
+	}
+	return ""
+}
+
+func duLink(eDir string, i map[string]string) string {
+	if !*duOn {
+		return ""
+	}
+	return `<A HREF="` + *wfmPfx + `?fn=du&amp;dir=` + eDir + `&amp;sort=">` + i["tdu"] + `Usage</A>`
+}
+
+func trashLink(eDir string, i map[string]string) string {
+	if *hardDelete {
+		return ""
+	}
+	return `<A HREF="` + *wfmPfx + `?fn=trash&amp;dir=` + eDir + `&amp;sort=">` + i["ttr"] + `Trash</A>`
+}
+
 func icons(b bool) map[string]string {
 	if b {
 		return map[string]string{
@@ -262,9 +408,15 @@ func icons(b bool) map[string]string {
 
 			"rm": "&#x274C;",
 			"mv": "&#x1F69A;",
+			"cp": "&#x1F4CB;",
+			"pr": "&#x2139;&#xFE0F;",
+			"ck": "&#x1F9EE;",
+			"ex": "&#x1F4E6;",
 			"re": "&#x1F4AC;",
 			"ed": "&#x1F4DD;",
+			"hs": "&#x1F552;",
 			"dn": "&#x1F4BE;",
+			"sh": "&#x1F4E4;",
 
 			"tcd": "&#x1F371; ",
 			"tup": "&#x1F53A; ",
@@ -272,11 +424,25 @@ func icons(b bool) map[string]string {
 			"tre": "&#x1F300; ",
 			"trm": "&#x274C; ",
 			"tmv": "&#x1F69A; ",
+			"tcp": "&#x1F4CB; ",
+			"tpr": "&#x2139;&#xFE0F; ",
+			"tdn": "&#x1F4BE; ",
+			"tzp": "&#x1F5DC;&#xFE0F; ",
 			"tln": "&#x1F310; ",
+			"tsl": "&#x1F517; ",
+			"thl": "&#x26D3;&#xFE0F; ",
 			"tfi": "&#x1F4D2; ",
 			"tdi": "&#x1F4C2; ",
 			"tul": "&#x1F680; ",
 
+			"tsh": "&#x1F4E4; ",
+			"tse": "&#x1F50D; ",
+			"tfl": "&#x1F5C2; ",
+			"tsa": "&#x2611;&#xFE0F; ",
+			"tjo": "&#x23F3; ",
+			"tdu": "&#x1F4CA; ",
+			"tdp": "&#x1F46F; ",
+			"ttr": "&#x1F5D1; ",
 			"tid": "&#x1F3AB; ",
 			"tve": "&#x1F9F0; ",
 		}
@@ -289,9 +455,15 @@ func icons(b bool) map[string]string {
 
 		"rm": "[rm]",
 		"mv": "[mv]",
+		"cp": "[cp]",
+		"pr": "[pr]",
+		"ck": "[ck]",
+		"ex": "[ex]",
 		"re": "[re]",
 		"ed": "[ed]",
+		"hs": "[hs]",
 		"dn": "[dn]",
+		"sh": "[sh]",
 
 		"tup": "^ ",
 		"tho": "~ ",
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// directory sizes are computed by a background worker which doesn't cross
+// filesystems, each directory is listed again only if its mtime changed or
+// its entry is older than du_ttl, so recomputing a large tree is mostly stats,
+// a cached size is used only while no directory below changed its mtime
+
+const duMaxEntr = 200000
+
+var (
+	duCache = newDuCache()
+)
+
+type duDir struct {
+	mtime time.Time
+	at    time.Time
+	own   uint64   // size of files directly in the directory
+	subs  []string // subdirectories on the same filesystem
+	total uint64   // recursive size, valid if done
+	done  bool
+}
+
+type duDB struct {
+	entr  map[string]*duDir
+	busy  map[string]bool
+	queue chan string
+	sync.Mutex
+}
+
+func newDuCache() *duDB {
+	db := new(duDB)
+	db.entr = make(map[string]*duDir)
+	db.busy = make(map[string]bool)
+	db.queue = make(chan string, 1000)
+	return db
+}
+
+// get returns recursive size of directory fp with modification time mt,
+// a missing or outdated size is queued for computing
+func (db *duDB) get(fp string, mt time.Time) (uint64, bool) {
+	if !*duOn {
+		return 0, false
+	}
+	fp = filepath.Clean(fp)
+	db.Lock()
+	d, ok := db.entr[fp]
+	var sub map[string]time.Time
+	if ok && d.done && d.mtime.Equal(mt) && time.Since(d.at) < *duTTL {
+		sub = db.below(fp, d)
+	}
+	db.Unlock()
+	if sub != nil && !mtimesChanged(sub) {
+		return d.total, true
+	}
+	db.Lock()
+	defer db.Unlock()
+	if !db.busy[fp] {
+		select {
+		case db.queue <- fp:
+			db.busy[fp] = true
+		default:
+		}
+	}
+	if ok && d.done {
+		return d.total, true
+	}
+	return 0, false
+}
+
+// below returns cached mtimes of all directories under fp, nil if some of them
+// are not cached, must be called with lock held
+func (db *duDB) below(fp string, d *duDir) map[string]time.Time {
+	m := make(map[string]time.Time)
+	var walk func(fp string, d *duDir) bool
+	walk = func(fp string, d *duDir) bool {
+		for _, s := range d.subs {
+			p := fp + "/" + s
+			sd, ok := db.entr[p]
+			if !ok || !sd.done {
+				return false
+			}
+			m[p] = sd.mtime
+			if !walk(p, sd) {
+				return false
+			}
+		}
+		return true
+	}
+	if !walk(fp, d) {
+		return nil
+	}
+	return m
+}
+
+func mtimesChanged(m map[string]time.Time) bool {
+	for p, mt := range m {
+		fi, err := os.Lstat(p)
+		if err != nil || !fi.ModTime().Equal(mt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *duDB) run() {
+	for fp := range db.queue {
+		fi, err := os.Lstat(fp)
+		if err == nil {
+			db.total(fp, devNo(fi))
+		}
+		db.Lock()
+		delete(db.busy, fp)
+		db.Unlock()
+	}
+}
+
+// total computes recursive size of fp, reusing listings of unchanged directories
+func (db *duDB) total(fp string, dev uint64) uint64 {
+	fi, err := os.Lstat(fp)
+	if err != nil || !fi.IsDir() || devNo(fi) != dev || deniedPfx(fp) {
+		return 0
+	}
+	db.Lock()
+	d, ok := db.entr[fp]
+	db.Unlock()
+	if !ok || !d.mtime.Equal(fi.ModTime()) || time.Since(d.at) > *duTTL {
+		d = &duDir{mtime: fi.ModTime(), at: time.Now()}
+		l, _ := ioutil.ReadDir(fp)
+		for _, f := range l {
+			if f.IsDir() {
+				d.subs = append(d.subs, f.Name())
+				continue
+			}
+			d.own += uint64(f.Size())
+		}
+	}
+	t := d.own
+	for _, s := range d.subs {
+		t += db.total(fp+"/"+s, dev)
+	}
+	db.Lock()
+	if _, ok := db.entr[fp]; !ok && len(db.entr) >= duMaxEntr {
+		db.evict()
+	}
+	db.entr[fp] = &duDir{mtime: d.mtime, at: d.at, own: d.own, subs: d.subs, total: t, done: true}
+	db.Unlock()
+	return t
+}
+
+// evict drops entries older than du_ttl and then arbitrary ones until a tenth
+// of the cache is free, must be called with lock held
+func (db *duDB) evict() {
+	for p, d := range db.entr {
+		if time.Since(d.at) > *duTTL {
+			delete(db.entr, p)
+		}
+	}
+	for p := range db.entr {
+		if len(db.entr) <= duMaxEntr-duMaxEntr/10 {
+			break
+		}
+		delete(db.entr, p)
+	}
+}
+
+func devNo(fi os.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(st.Dev)
+}
+
+// duCol returns directory size for the listing size column
+func duCol(fp string, fi os.FileInfo) string {
+	if !*duOn {
+		return "&nbsp;"
+	}
+	s, ok := duCache.get(fp, fi.ModTime())
+	if !ok {
+		return `<FONT COLOR="#808080">...</FONT>`
+	}
+	return humanize.Bytes(s)
+}
+
+// diskUsage shows entries of uDir sorted by size
+func diskUsage(w http.ResponseWriter, uDir, eSort string) {
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	if !*duOn {
+		htErr(w, "disk usage", fmt.Errorf("directory sizes are disabled"))
+		return
+	}
+	l, err := ioutil.ReadDir(uDir)
+	if err != nil {
+		htErr(w, "disk usage", err)
+		return
+	}
+	type usage struct {
+		name string
+		dir  bool
+		size uint64
+		ok   bool
+	}
+	u := []usage{}
+	var total uint64
+	pending := 0
+	for _, f := range l {
+		if deniedPfx(uDir + "/" + f.Name()) {
+			continue
+		}
+		e := usage{name: f.Name(), dir: f.IsDir(), size: uint64(f.Size()), ok: true}
+		if f.IsDir() {
+			e.size, e.ok = duCache.get(uDir+"/"+f.Name(), f.ModTime())
+			if !e.ok {
+				pending++
+			}
+		}
+		total += e.size
+		u = append(u, e)
+	}
+	sort.Slice(u, func(i, j int) bool {
+		return u[i].size > u[j].size
+	})
+
+	header(w, uDir, eSort)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD COLSPAN="4" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Disk usage of ` + html.EscapeString(uDir) + `</FONT></TD></TR>
+    <TR BGCOLOR="#A0A0A0">
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Name</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Size</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">%</FONT></TD>
+    <TD WIDTH="50%">&nbsp;</TD>
+    </TR>
+    `))
+	for n, e := range u {
+		nm := html.EscapeString(e.name)
+		if e.dir {
+			nm = `<A HREF="` + *wfmPfx + `?fn=du&amp;dir=` + url.QueryEscape(uDir+"/"+e.name) + `&amp;sort=` + html.EscapeString(eSort) + `">` + nm + `/</A>`
+		}
+		sz, pc, bar := `<FONT COLOR="#808080">...</FONT>`, "&nbsp;", 0
+		if e.ok {
+			sz = humanize.Bytes(e.size)
+			if total > 0 {
+				bar = int(e.size * 100 / total)
+				pc = fmt.Sprint(bar)
+			}
+		}
+		fmt.Fprintf(w, `<TR BGCOLOR="%v"><TD NOWRAP>%v</TD><TD NOWRAP ALIGN="right">%v</TD><TD NOWRAP ALIGN="right">%v</TD>`+
+			`<TD><TABLE WIDTH="%v%%" CELLPADDING="0" CELLSPACING="0" BORDER="0"><TR><TD BGCOLOR="#0072C6" HEIGHT="8"></TD></TR></TABLE></TD></TR>`+"\n",
+			rowColor(n, false), nm, sz, pc, bar+1)
+	}
+	st := ""
+	if pending > 0 {
+		st = fmt.Sprintf(", %v directories are still being computed, refresh to update", pending)
+	}
+	w.Write([]byte(`<TR><TD STYLE="border-top:1px solid grey">Total</TD><TD ALIGN="right" STYLE="border-top:1px solid grey">` +
+		humanize.Bytes(total) + `</TD><TD COLSPAN="2" STYLE="border-top:1px solid grey">` + st + `</TD></TR></TABLE><P>
+    &nbsp;<INPUT TYPE="SUBMIT" VALUE=" OK " NAME="OK">
+    `))
+	footer(w)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// duplicates are found by grouping files by size, then by hash of the first
+// dupPart bytes and only the remaining candidates are read whole, files which
+// are already hard linked together count as one
+
+const dupPart = 64 << 10
+
+var (
+	dupCache = newDupCache()
+)
+
+type dupFile struct {
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+type dupGroup struct {
+	size  int64
+	files []dupFile
+}
+
+func (g dupGroup) wasted() uint64 {
+	return uint64(g.size) * uint64(len(g.files)-1)
+}
+
+type dupReport struct {
+	at     time.Time
+	groups []dupGroup
+}
+
+type dupDB struct {
+	reports map[string]*dupReport
+	sync.Mutex
+}
+
+func newDupCache() *dupDB {
+	db := new(dupDB)
+	db.reports = make(map[string]*dupReport)
+	return db
+}
+
+// findDups scans the tree from uDir in a job and shows the duplicate groups
+func findDups(w http.ResponseWriter, uDir, eSort, user string) {
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	root := filepath.Clean(uDir)
+	j := jobs.start(user, "find duplicates in "+root, func(ctx context.Context, j *job) error {
+		bySize := make(map[int64][]dupFile)
+		seen := make(map[[2]uint64]bool)
+		err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil || p == root {
+				return nil
+			}
+			if deniedPfx(p) || (!*showDot && strings.HasPrefix(fi.Name(), ".")) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !fi.Mode().IsRegular() || fi.Size() == 0 {
+				return nil
+			}
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				id := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+				if seen[id] {
+					return nil
+				}
+				seen[id] = true
+			}
+			bySize[fi.Size()] = append(bySize[fi.Size()], dupFile{path: p, size: fi.Size(), mtime: fi.ModTime()})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		r := &dupReport{at: time.Now()}
+		for size, fl := range bySize {
+			if len(fl) < 2 {
+				continue
+			}
+			for _, pl := range dupSplit(fl, func(f dupFile) (string, error) {
+				return partHash(f.path)
+			}) {
+				if size <= dupPart {
+					r.groups = append(r.groups, dupGroup{size: size, files: pl})
+					continue
+				}
+				j.addTotal(size * int64(len(pl)))
+				for _, gl := range dupSplit(pl, func(f dupFile) (string, error) {
+					return fullHash(ctx, j, f.path)
+				}) {
+					r.groups = append(r.groups, dupGroup{size: size, files: gl})
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+			}
+		}
+		var wasted uint64
+		for _, g := range r.groups {
+			sort.Slice(g.files, func(a, b int) bool {
+				return g.files[a].path < g.files[b].path
+			})
+			wasted += g.wasted()
+		}
+		sort.Slice(r.groups, func(a, b int) bool {
+			return r.groups[a].wasted() > r.groups[b].wasted()
+		})
+		dupCache.Lock()
+		dupCache.reports[root] = r
+		dupCache.Unlock()
+		j.Lock()
+		j.Result = fmt.Sprintf("%d groups, %v wasted", len(r.groups), humanize.Bytes(wasted))
+		j.Unlock()
+		return nil
+	})
+	jobRedirect(w, j, *wfmPfx+"?fn=dups&dir="+url.QueryEscape(root)+"&sort="+eSort, root, eSort)
+}
+
+// dupSplit groups files by key, leaving out unique and unreadable ones
+func dupSplit(fl []dupFile, key func(dupFile) (string, error)) [][]dupFile {
+	m := make(map[string][]dupFile)
+	for _, f := range fl {
+		k, err := key(f)
+		if err != nil {
+			continue
+		}
+		m[k] = append(m[k], f)
+	}
+	l := [][]dupFile{}
+	for _, g := range m {
+		if len(g) > 1 {
+			l = append(l, g)
+		}
+	}
+	return l
+}
+
+func partHash(fp string) (string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, io.LimitReader(f, dupPart))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fullHash(ctx context.Context, j *job, fp string) (string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, &jobReader{ctx: ctx, j: j, r: f})
+	if err != nil {
+		return "", err
+	}
+	j.progress(0, 1)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listDups shows the last duplicate scan of uDir or starts one
+func listDups(w http.ResponseWriter, uDir, eSort, user string, rw bool) {
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	dupCache.Lock()
+	r, ok := dupCache.reports[uDir]
+	dupCache.Unlock()
+	if !ok {
+		findDups(w, uDir, eSort, user)
+		return
+	}
+	dupCache.Lock()
+	gl := r.groups
+	dupCache.Unlock()
+	var wasted uint64
+	for _, g := range gl {
+		wasted += g.wasted()
+	}
+	header(w, uDir, eSort)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD COLSPAN="3" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Duplicates in ` + html.EscapeString(uDir) + `, ` +
+		fmt.Sprintf("%d groups, %v wasted, scanned %v", len(gl), humanize.Bytes(wasted), humanize.Time(r.at)) + `</FONT></TD></TR>
+    `))
+	for _, g := range gl {
+		fmt.Fprintf(w, `<TR BGCOLOR="#A0A0A0"><TD COLSPAN="3"><FONT COLOR="#FFFFFF">&nbsp;%d copies of %v, %v wasted</FONT></TD></TR>`+"\n",
+			len(g.files), humanize.Bytes(uint64(g.size)), humanize.Bytes(g.wasted()))
+		for n, f := range g.files {
+			ck := ""
+			if rw {
+				ck = `<INPUT TYPE="CHECKBOX" NAME="dupf" VALUE="` + html.EscapeString(f.path) + `">`
+			}
+			rel, _ := filepath.Rel(uDir, f.path)
+			fmt.Fprintf(w, `<TR BGCOLOR="%v"><TD NOWRAP>%v<A HREF="%v?fn=disp&amp;fp=%v">%v</A></TD>`+
+				`<TD NOWRAP ALIGN="right">(%v) %v</TD><TD NOWRAP ALIGN="right"><A HREF="%v?dir=%v&amp;sort=%v&amp;hi=%v">folder</A>&nbsp;</TD></TR>`+"\n",
+				rowColor(n, false), ck, *wfmPfx, url.QueryEscape(f.path), html.EscapeString(rel),
+				humanize.Time(f.mtime), f.mtime.Format(time.Stamp),
+				*wfmPfx, url.QueryEscape(filepath.Dir(f.path)), html.EscapeString(eSort), url.QueryEscape(filepath.Base(f.path)))
+		}
+	}
+	act := ""
+	if rw && len(gl) > 0 {
+		act = `<INPUT TYPE="SUBMIT" VALUE="Delete selected" NAME="dupdel">
+    <INPUT TYPE="SUBMIT" VALUE="Replace selected with hard links" NAME="duplink">
+    <INPUT TYPE="HIDDEN" NAME="fn" VALUE="dupact">`
+	}
+	w.Write([]byte(`
+    </TABLE><P>
+    &nbsp;` + act + `
+    <INPUT TYPE="SUBMIT" VALUE="Scan again" NAME="dupscan">
+    <INPUT TYPE="SUBMIT" VALUE=" OK " NAME="cancel">
+    `))
+	footer(w)
+}
+
+// dupAction deletes or hard links the selected duplicates, at least one copy
+// in every group has to stay unselected and is used as the link target
+func dupAction(w http.ResponseWriter, r *http.Request, uDir, eSort, user string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	link := r.FormValue("duplink") != ""
+	sel := make(map[string]bool)
+	for _, f := range r.Form["dupf"] {
+		sel[filepath.Clean(f)] = true
+	}
+	if len(sel) == 0 {
+		htErr(w, "duplicates", fmt.Errorf("no files selected"))
+		return
+	}
+	dupCache.Lock()
+	rep, ok := dupCache.reports[uDir]
+	dupCache.Unlock()
+	if !ok {
+		htErr(w, "duplicates", fmt.Errorf("no duplicate scan for %v", uDir))
+		return
+	}
+
+	// replace maps selected files to the copy which is kept
+	replace := make(map[string]string)
+	dupCache.Lock()
+	for _, g := range rep.groups {
+		keep := ""
+		for _, f := range g.files {
+			if !sel[f.path] {
+				keep = f.path
+				break
+			}
+		}
+		for _, f := range g.files {
+			if !sel[f.path] {
+				continue
+			}
+			if keep == "" {
+				dupCache.Unlock()
+				htErr(w, "duplicates", fmt.Errorf("all copies of %v are selected, keep at least one", filepath.Base(f.path)))
+				return
+			}
+			replace[f.path] = keep
+		}
+	}
+	dupCache.Unlock()
+
+	desc := "delete duplicates in " + uDir
+	if link {
+		desc = "hard link duplicates in " + uDir
+	}
+	j := jobs.start(user, desc, func(ctx context.Context, j *job) error {
+		done := make(map[string]bool)
+		defer dupCache.forget(uDir, done)
+		for p, keep := range replace {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if deniedPfx(p) || deniedPfx(keep) {
+				return fmt.Errorf("%v: forbidden", p)
+			}
+			err := dupUnchanged(rep, p, keep)
+			if err != nil {
+				return err
+			}
+			switch {
+			case link:
+				if !sameFs(p, keep) {
+					return fmt.Errorf("%v: not on the same filesystem as %v", p, keep)
+				}
+				tmp := fmt.Sprintf("%v/.wfm-link-%d", filepath.Dir(p), time.Now().UnixNano())
+				err = os.Link(keep, tmp)
+				if err != nil {
+					return err
+				}
+				err = os.Rename(tmp, p)
+				if err != nil {
+					os.Remove(tmp)
+					return err
+				}
+			case *hardDelete:
+				err = os.Remove(p)
+			default:
+				err = trashFile(ctx, j, p)
+			}
+			if err != nil {
+				return err
+			}
+			j.progress(0, 1)
+			done[p] = true
+		}
+		return nil
+	})
+	jobRedirect(w, j, *wfmPfx+"?fn=dups&dir="+url.QueryEscape(uDir)+"&sort="+eSort, uDir, eSort)
+}
+
+// dupUnchanged checks that p and keep still have size and mtime recorded by the scan
+func dupUnchanged(rep *dupReport, p, keep string) error {
+	dupCache.Lock()
+	defer dupCache.Unlock()
+	for _, g := range rep.groups {
+		for _, f := range g.files {
+			if f.path != p && f.path != keep {
+				continue
+			}
+			fi, err := os.Lstat(f.path)
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() || fi.Size() != f.size || !fi.ModTime().Equal(f.mtime) {
+				return fmt.Errorf("%v changed since the scan, scan again", f.path)
+			}
+		}
+	}
+	return nil
+}
+
+// forget removes handled files from the report of uDir, dropping groups left with one file
+func (db *dupDB) forget(uDir string, done map[string]bool) {
+	db.Lock()
+	defer db.Unlock()
+	r, ok := db.reports[uDir]
+	if !ok {
+		return
+	}
+	gl := []dupGroup{}
+	for _, g := range r.groups {
+		fl := []dupFile{}
+		for _, f := range g.files {
+			if !done[f.path] {
+				fl = append(fl, f)
+			}
+		}
+		if len(fl) > 1 {
+			gl = append(gl, dupGroup{size: g.size, files: fl})
+		}
+	}
+	r.groups = gl
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/kdomanski/iso9660"
+	"github.com/mholt/archiver/v4"
+)
+
+// archives are extracted by a job which refuses members with absolute or
+// climbing paths, never writes through symlinks leading outside of the
+// destination and stops at extract_max_files entries, extract_max_size bytes
+// or when the output is more than extract_max_ratio times the archive size,
+// symlinks are created last and checked again once they all exist as one
+// link can change where another one leads
+
+var arcDecomp = map[string]archiver.Decompressor{
+	".gz":  archiver.Gz{},
+	".bz2": archiver.Bz2{},
+	".xz":  archiver.Xz{},
+}
+
+// arcEntry is a member of an archive, link is the target of symbolic and hard links
+type arcEntry struct {
+	name string
+	mode os.FileMode
+	link string
+	open func() (io.ReadCloser, error)
+}
+
+// walkArchive calls fn for every member of archive fp
+func walkArchive(ctx context.Context, fp string, fn func(arcEntry) error) error {
+	switch strings.ToLower(filepath.Ext(fp)) {
+	case ".7z":
+		return walk7z(ctx, fp, fn)
+	case ".iso":
+		return walkIso(ctx, fp, fn)
+	}
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n := strings.TrimSuffix(filepath.Base(fp), filepath.Ext(fp))
+	if d, ok := arcDecomp[strings.ToLower(filepath.Ext(fp))]; ok && !strings.HasSuffix(strings.ToLower(n), ".tar") {
+		// a single compressed file like notes.txt.gz, archiver fails to identify these
+		return fn(arcEntry{name: n, mode: 0644, open: func() (io.ReadCloser, error) {
+			return d.OpenReader(f)
+		}})
+	}
+	format, err := archiver.Identify(filepath.Base(fp), f)
+	if err != nil {
+		return err
+	}
+	a, ok := format.(archiver.Extractor)
+	if !ok {
+		return fmt.Errorf("unsupported archive format")
+	}
+	return a.Extract(ctx, f, nil, func(ctx context.Context, af archiver.File) error {
+		return fn(arcEntry{name: af.NameInArchive, mode: af.Mode(), link: af.LinkTarget, open: af.Open})
+	})
+}
+
+func walk7z(ctx context.Context, fp string, fn func(arcEntry) error) error {
+	a, err := sevenzip.OpenReader(fp)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	for _, f := range a.File {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = fn(arcEntry{name: f.Name, mode: f.Mode(), open: f.Open})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkIso(ctx context.Context, fp string, fn func(arcEntry) error) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, err := iso9660.OpenImage(f)
+	if err != nil {
+		return err
+	}
+	root, err := img.RootDir()
+	if err != nil {
+		return err
+	}
+	var walk func(pfx string, d *iso9660.File) error
+	walk = func(pfx string, d *iso9660.File) error {
+		cl, err := d.GetChildren()
+		if err != nil {
+			return err
+		}
+		for _, c := range cl {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			n := pfx + c.Name()
+			if c.IsDir() {
+				err = fn(arcEntry{name: n, mode: os.ModeDir | 0755})
+				if err == nil {
+					err = walk(n+"/", c)
+				}
+			} else {
+				r := c.Reader()
+				err = fn(arcEntry{name: n, mode: 0644, open: func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(r), nil
+				}})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk("", root)
+}
+
+// arcPath returns cleaned relative path of an archive member, false for
+// absolute paths and paths climbing out of the destination
+func arcPath(n string) (string, bool) {
+	n = strings.ReplaceAll(n, "\\", "/")
+	if strings.HasPrefix(n, "/") {
+		return "", false
+	}
+	c := path.Clean(n)
+	if c == ".." || strings.HasPrefix(c, "../") {
+		return "", false
+	}
+	if c == "." {
+		return "", true
+	}
+	return c, true
+}
+
+// arcBase returns archive file name without archive extensions
+func arcBase(n string) string {
+	l := strings.ToLower(n)
+	for _, e := range []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tar.zst"} {
+		if strings.HasSuffix(l, e) {
+			return n[:len(n)-len(e)]
+		}
+	}
+	b := strings.TrimSuffix(n, filepath.Ext(n))
+	if b == "" {
+		return n
+	}
+	return b
+}
+
+type extractor struct {
+	ctx     context.Context
+	j       *job
+	root    string // destination with symlinks resolved
+	policy  string
+	limit   int64 // maximum output size from extract_max_size and extract_max_ratio
+	ratio   bool  // limit comes from the ratio
+	entries int
+	done    int
+	skipped int
+	written int64
+	links   []arcLink
+}
+
+// arcLink is a symlink to be created after all other members
+type arcLink struct {
+	name   string
+	target string
+	dst    string
+}
+
+// inside creates directory dir unless it exists and reports whether it
+// resolves to a path within the destination which isn't denied
+func (x *extractor) inside(dir string) bool {
+	p := dir
+	for {
+		_, err := os.Lstat(p)
+		if err == nil || p == x.root || p == "/" {
+			break
+		}
+		p = filepath.Dir(p)
+	}
+	r, err := filepath.EvalSymlinks(p)
+	if err != nil || (r != x.root && !strings.HasPrefix(r, x.root+"/")) || deniedPfx(r) {
+		return false
+	}
+	if p == dir {
+		fi, err := os.Stat(dir)
+		return err == nil && fi.IsDir()
+	}
+	return os.MkdirAll(dir, 0755) == nil && x.inside(dir)
+}
+
+// conflict returns where to write dst according to policy, empty to skip it
+func (x *extractor) conflict(dst string) (string, error) {
+	fi, err := os.Lstat(dst)
+	if err != nil {
+		return dst, nil
+	}
+	switch {
+	case x.policy == "rename":
+		return uniqName(dst), nil
+	case x.policy == "overwrite" && !fi.IsDir():
+		return dst, os.Remove(dst)
+	}
+	return "", nil
+}
+
+func (x *extractor) entry(e arcEntry) error {
+	if x.ctx.Err() != nil {
+		return x.ctx.Err()
+	}
+	x.entries++
+	if x.entries > *extMaxFiles {
+		return fmt.Errorf("archive has more than %v entries", *extMaxFiles)
+	}
+	rel, ok := arcPath(e.name)
+	if !ok {
+		log.Printf("extract: refusing unsafe path %q", e.name)
+		x.skipped++
+		return nil
+	}
+	if rel == "" {
+		return nil
+	}
+	dst := x.root + "/" + rel
+	if !x.inside(filepath.Dir(dst)) {
+		log.Printf("extract: refusing %q, parent directory is outside of destination", e.name)
+		x.skipped++
+		return nil
+	}
+
+	if e.mode.IsDir() {
+		fi, err := os.Lstat(dst)
+		if err == nil && fi.IsDir() {
+			return nil
+		}
+		if err == nil {
+			x.skipped++
+			return nil
+		}
+		err = os.Mkdir(dst, e.mode.Perm()|0700)
+		if err != nil {
+			return err
+		}
+		x.done++
+		x.j.progress(0, 1)
+		return nil
+	}
+
+	var t string
+	switch {
+	case e.mode&os.ModeSymlink != 0:
+		t = e.link
+		if t == "" && e.open != nil {
+			// zip and 7z store the target as content
+			r, err := e.open()
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+			r.Close()
+			if err != nil {
+				return err
+			}
+			t = string(b)
+		}
+		if t == "" || filepath.IsAbs(t) {
+			log.Printf("extract: refusing symlink %q to %q", e.name, t)
+			x.skipped++
+			return nil
+		}
+		x.links = append(x.links, arcLink{name: e.name, target: t, dst: dst})
+		return nil
+	case e.link != "":
+		// hard link to an earlier member
+		lr, ok := arcPath(e.link)
+		t = x.root + "/" + lr
+		fi, err := os.Lstat(t)
+		if !ok || lr == "" || err != nil || !fi.Mode().IsRegular() || !x.inside(filepath.Dir(t)) {
+			log.Printf("extract: refusing hard link %q to %q", e.name, e.link)
+			x.skipped++
+			return nil
+		}
+	case !e.mode.IsRegular() || e.open == nil:
+		x.skipped++
+		return nil
+	}
+
+	dst, err := x.conflict(dst)
+	if err != nil {
+		return err
+	}
+	if dst == "" {
+		x.skipped++
+		return nil
+	}
+	if e.link != "" {
+		err = os.Link(t, dst)
+	} else {
+		err = x.file(e, dst)
+	}
+	if err != nil {
+		return err
+	}
+	x.done++
+	x.j.progress(0, 1)
+	return nil
+}
+
+// within reports whether p resolves to a path within the destination which isn't denied
+func (x *extractor) within(p string) bool {
+	r, err := realPath(p)
+	return err == nil && (r == x.root || strings.HasPrefix(r, x.root+"/")) && !deniedPfx(r)
+}
+
+// symlinks creates the symlinks leading within the destination, then removes
+// those which lead out of it through links created after them
+func (x *extractor) symlinks() error {
+	made := []arcLink{}
+	for _, l := range x.links {
+		if x.ctx.Err() != nil {
+			return x.ctx.Err()
+		}
+		if !x.inside(filepath.Dir(l.dst)) || !x.within(filepath.Dir(l.dst)+"/"+l.target) {
+			log.Printf("extract: refusing symlink %q to %q", l.name, l.target)
+			x.skipped++
+			continue
+		}
+		dst, err := x.conflict(l.dst)
+		if err != nil {
+			return err
+		}
+		if dst == "" {
+			x.skipped++
+			continue
+		}
+		err = os.Symlink(l.target, dst)
+		if err != nil {
+			return err
+		}
+		made = append(made, arcLink{name: l.name, target: l.target, dst: dst})
+		x.done++
+		x.j.progress(0, 1)
+	}
+	for _, l := range made {
+		if x.within(l.dst) {
+			continue
+		}
+		log.Printf("extract: removing symlink %q to %q leading out of destination", l.name, l.target)
+		err := os.Remove(l.dst)
+		if err != nil {
+			return err
+		}
+		x.done--
+		x.skipped++
+	}
+	return nil
+}
+
+// file writes content of e to dst, counting the output against the limits
+func (x *extractor) file(e arcEntry, dst string) error {
+	r, err := e.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	m := e.mode.Perm()
+	if m == 0 {
+		m = 0644
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, m|0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, &jobReader{ctx: x.ctx, j: x.j, r: io.LimitReader(r, x.limit-x.written+1)})
+	x.written += n
+	if err == nil && x.written > x.limit {
+		err = fmt.Errorf("extracted size exceeds %v", extMaxSize)
+		if x.ratio {
+			err = fmt.Errorf("extracted size exceeds %v times the archive size, possible zip bomb", *extMaxRatio)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// extractArchive extracts uDir/uBn in to uDst, or in to a new folder there named
+// after the archive if sub, existing files are handled according to policy
+func extractArchive(w http.ResponseWriter, uDir, uBn, uDst string, sub bool, policy, eSort, user string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	fp := filepath.Clean(uDir + "/" + uBn)
+	if deniedPfx(fp) || deniedPfx(uDst) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	switch policy {
+	case "skip", "overwrite", "rename":
+	default:
+		policy = "skip"
+	}
+	fi, err := os.Stat(fp)
+	if err != nil {
+		htErr(w, "extract", err)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		htErr(w, "extract", fmt.Errorf("not a regular file"))
+		return
+	}
+	dst := filepath.Clean(uDst)
+	if sub {
+		dst = dst + "/" + arcBase(uBn)
+		if _, err := os.Lstat(dst); err == nil && policy == "rename" {
+			dst = uniqName(dst)
+		}
+		if deniedPfx(dst) {
+			htErr(w, "access", fmt.Errorf("forbidden"))
+			return
+		}
+	}
+	j := jobs.start(user, fmt.Sprintf("extract %v to %v", fp, dst), func(ctx context.Context, j *job) error {
+		created := false
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			err = os.Mkdir(dst, 0755)
+			if err != nil {
+				return err
+			}
+			created = true
+		}
+		r, err := filepath.EvalSymlinks(dst)
+		if err != nil {
+			return err
+		}
+		x := &extractor{ctx: ctx, j: j, root: r, policy: policy, limit: int64(extMaxSize)}
+		if *extMaxRatio > 0 && fi.Size()*int64(*extMaxRatio) < x.limit {
+			x.limit = fi.Size() * int64(*extMaxRatio)
+			// small archives of text compress very well
+			if x.limit < 1<<20 {
+				x.limit = 1 << 20
+			}
+			x.ratio = true
+		}
+		err = walkArchive(ctx, fp, x.entry)
+		if err == nil {
+			err = x.symlinks()
+		}
+		if err != nil {
+			if created {
+				os.RemoveAll(dst)
+			}
+			return err
+		}
+		j.Lock()
+		j.Result = fmt.Sprintf("%d entries extracted", x.done)
+		if x.skipped > 0 {
+			j.Result += fmt.Sprintf(", %d skipped", x.skipped)
+		}
+		j.Unlock()
+		return nil
+	})
+	hi := ""
+	if sub {
+		hi = filepath.Base(dst)
+	}
+	jobRedirect(w, j, *wfmPfx+"?dir="+url.QueryEscape(filepath.Clean(uDst))+"&sort="+eSort+"&hi="+url.QueryEscape(hi), uDir, eSort)
+}
+
+// isArchive tells if name can be extracted, same formats dispFile lists
+func isArchive(name string) bool {
+	switch strings.ToLower(strings.TrimPrefix(filepath.Ext(name), ".")) {
+	case "zip", "7z", "tar", "rar", "gz", "bz2", "xz", "tgz", "tbz2", "txz", "iso":
+		return true
+	}
+	return false
+}
@@ -2,20 +2,33 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/gabriel-vasile/mimetype"
 )
 
+var (
+	pendingUps = newPendingUps()
+)
+
 func deniedPfx(pfx string) bool {
 	cPfx := filepath.Clean(pfx)
 	for _, p := range denyPfxs {
@@ -23,10 +36,14 @@ func deniedPfx(pfx string) bool {
 			return true
 		}
 	}
+	// per filesystem trash directories can be anywhere
+	if !*hardDelete && strings.Contains(cPfx+"/", "/"+mountTrash()+"/") {
+		return true
+	}
 	return false
 }
 
-func dispFile(w http.ResponseWriter, uFilePath string) {
+func dispFile(w http.ResponseWriter, r *http.Request, uFilePath string) {
 	if deniedPfx(uFilePath) {
 		htErr(w, "access", fmt.Errorf("forbidden"))
 		return
@@ -48,127 +65,440 @@ func dispFile(w http.ResponseWriter, uFilePath string) {
 		listIso(w, fp)
 
 	default:
-		dispInline(w, fp)
+		dispInline(w, r, fp)
 	}
 }
 
-func downFile(w http.ResponseWriter, uFilePath string) {
+func downFile(w http.ResponseWriter, r *http.Request, uFilePath string) {
 	if deniedPfx(uFilePath) {
 		htErr(w, "access", fmt.Errorf("forbidden"))
 		return
 	}
-	f, err := os.Stat(uFilePath)
+	fi, err := os.Open(uFilePath)
 	if err != nil {
-		htErr(w, "Unable to get file attributes", err)
+		htErr(w, "Unable top open file", err)
 		return
 	}
+	defer fi.Close()
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(uFilePath)+"\";")
-	w.Header().Set("Content-Length", fmt.Sprint(f.Size()))
-	w.Header().Set("Cache-Control", *cacheCtl)
-	streamFile(w, uFilePath)
+	serveFile(w, r, fi)
 }
 
-func dispInline(w http.ResponseWriter, uFilePath string) {
+func dispInline(w http.ResponseWriter, r *http.Request, uFilePath string) {
 	if deniedPfx(uFilePath) {
 		htErr(w, "access", fmt.Errorf("forbidden"))
 		return
 	}
-	f, err := os.Stat(uFilePath)
-	if err != nil {
-		htErr(w, "Unable to get file attributes", err)
-		return
-	}
+	inlineFile(w, r, uFilePath)
+}
 
-	fi, err := os.Open(uFilePath)
+// inlineFile displays fp in browser with detected content type, without access checks
+func inlineFile(w http.ResponseWriter, r *http.Request, fp string) {
+	fi, err := os.Open(fp)
 	if err != nil {
 		htErr(w, "Unable top open file", err)
 		return
 	}
+	defer fi.Close()
 	mt, err := mimetype.DetectReader(fi)
 	if err != nil {
 		htErr(w, "Unable to determine file type", err)
 		return
 	}
-	fi.Close()
+	_, err = fi.Seek(0, io.SeekStart)
+	if err != nil {
+		htErr(w, "Unable to read file", err)
+		return
+	}
 
 	w.Header().Set("Content-Type", mt.String())
 	w.Header().Set("Content-Disposition", "inline")
-	w.Header().Set("Content-Length", fmt.Sprint(f.Size()))
-	w.Header().Set("Cache-Control", *cacheCtl)
-	streamFile(w, uFilePath)
+	serveFile(w, r, fi)
 }
 
-func streamFile(w http.ResponseWriter, uFilePath string) {
-	if deniedPfx(uFilePath) {
-		htErr(w, "access", fmt.Errorf("forbidden"))
+// serveFile sends an open file with validators and lets http.ServeContent
+// handle Range, If-Range, If-Modified-Since and If-None-Match
+func serveFile(w http.ResponseWriter, r *http.Request, fi *os.File) {
+	f, err := fi.Stat()
+	if err != nil {
+		htErr(w, "Unable to get file attributes", err)
 		return
 	}
-	fi, err := os.Open(uFilePath)
-	if err != nil {
-		htErr(w, "Unable top open file", err)
-		log.Printf("unable to read file: %v", err)
+	if f.IsDir() {
+		htErr(w, "download", fmt.Errorf("is a directory"))
 		return
 	}
-	defer fi.Close()
+	w.Header().Set("Etag", fmt.Sprintf("\"%x-%x\"", f.Size(), f.ModTime().UnixNano()))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Cache-Control", *cacheCtl)
+	http.ServeContent(w, r, f.Name(), f.ModTime(), fi)
+}
 
-	rb := bufio.NewReader(fi)
-	wb := bufio.NewWriter(w)
-	bu := make([]byte, 1<<20)
+// upFile is an uploaded file already streamed to a temp file in the destination directory,
+// name is relative to the destination and may contain subdirectories for folder uploads
+type upFile struct {
+	name string
+	tmp  string
+	size int64
+	err  error
+	keep bool
+}
 
+// readForm parses the request form, for multipart requests file parts are streamed
+// directly to a temp file in the destination directory instead of memory or os temp dir,
+// the destination is taken from the dir form field unless upDir is set, in which case
+// folder paths are dropped and files land directly in upDir, quota limits total size
+// of the files, negative for no limit
+func readForm(r *http.Request, rw bool, upDir string, quota int64) ([]upFile, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	mr, err := r.MultipartReader()
+	if err == http.ErrNotMultipart {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	up := []upFile{}
+	max := int64(10 << 20)
 	for {
-		n, err := rb.Read(bu)
-		if err != nil && err != io.EOF {
-			htErr(w, "Unable to read file", err)
-			log.Printf("unable to read file: %v", err)
-			return
-		}
-		if n == 0 {
+		p, err := mr.NextPart()
+		if err == io.EOF {
 			break
 		}
-		wb.Write(bu[:n])
+		if err != nil {
+			return up, err
+		}
+		fn := partFileName(p)
+		if fn == "" {
+			v, err := ioutil.ReadAll(io.LimitReader(p, max+1))
+			if err != nil {
+				return up, err
+			}
+			max -= int64(len(v))
+			if max < 0 {
+				return up, fmt.Errorf("form too large")
+			}
+			r.Form.Add(p.FormName(), string(v))
+			r.PostForm.Add(p.FormName(), string(v))
+			continue
+		}
+		uDir := upDir
+		if uDir == "" {
+			uDir = cleanDir(r.Form.Get("dir"))
+		} else {
+			fn = filepath.Base(fn)
+		}
+		if !rw || deniedPfx(uDir) {
+			io.Copy(ioutil.Discard, p)
+			continue
+		}
+		u, err := streamPart(p, fn, uDir, r.ContentLength, quota)
+		if err != nil && u.err == nil {
+			u.err = err
+		}
+		up = append(up, u)
+		if err != nil {
+			return up, err
+		}
+		if quota >= 0 && u.err == nil {
+			quota -= u.size
+		}
 	}
-	wb.Flush()
+	return up, nil
 }
 
-func uploadFile(w http.ResponseWriter, uDir, eSort string, h *multipart.FileHeader, f multipart.File, rw bool) {
-	if !rw {
-		htErr(w, "permission", fmt.Errorf("read only"))
-		return
+// partFileName returns file name including relative path sent by folder uploads,
+// which multipart.Part.FileName() strips
+func partFileName(p *multipart.Part) string {
+	_, prm, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil || prm["filename"] == "" {
+		return ""
+	}
+	return strings.TrimPrefix(filepath.Clean("/"+prm["filename"]), "/")
+}
+
+// streamPart writes part to a temp file, errors reading the request are returned,
+// rejected files have u.err set and the rest of the form is still processed, except
+// when quota is exceeded as nothing more would fit
+func streamPart(p *multipart.Part, fn, uDir string, cLen, quota int64) (upFile, error) {
+	u := upFile{name: fn}
+	u.err = checkFree(uDir, cLen)
+	if u.err != nil {
+		_, err := io.Copy(ioutil.Discard, p)
+		return u, err
+	}
+	o, err := os.CreateTemp(uDir, ".wfm-upload-*")
+	if err != nil {
+		u.err = err
+		_, err := io.Copy(ioutil.Discard, p)
+		return u, err
 	}
-	if deniedPfx(uDir) {
-		htErr(w, "access", fmt.Errorf("forbidden"))
-		return
+	defer o.Close()
+	u.tmp = o.Name()
+	var rd io.Reader = p
+	max := int64(-1)
+	if maxUpload > 0 {
+		max = int64(maxUpload)
+	}
+	if quota >= 0 && (max < 0 || quota < max) {
+		max = quota
+	}
+	if max >= 0 {
+		rd = io.LimitReader(p, max+1)
+	}
+	wb := bufio.NewWriterSize(o, 1<<20)
+	u.size, err = io.Copy(wb, rd)
+	if err != nil {
+		return u, err
+	}
+	if max >= 0 && u.size > max {
+		if max == quota {
+			u.err = fmt.Errorf("exceeds quota, %v left", humanize.Bytes(uint64(quota)))
+			return u, u.err
+		}
+		u.err = fmt.Errorf("larger than %v", maxUpload.String())
+		_, err := io.Copy(ioutil.Discard, p)
+		return u, err
+	}
+	u.err = wb.Flush()
+	if u.err != nil {
+		return u, nil
+	}
+	u.err = o.Chmod(0644)
+	return u, nil
+}
+
+func cleanUploads(up []upFile) {
+	for _, u := range up {
+		if u.keep || u.tmp == "" {
+			continue
+		}
+		os.Remove(u.tmp)
+	}
+}
+
+// pendingUp is an upload waiting for its owner to resolve a name conflict
+type pendingUp struct {
+	user string
+	dir  string
+	upFile
+	at time.Time
+}
+
+type pendingDB struct {
+	entr map[string]pendingUp
+	sync.Mutex
+}
+
+func newPendingUps() *pendingDB {
+	db := new(pendingDB)
+	db.entr = make(map[string]pendingUp)
+	return db
+}
+
+// add keeps u for user and returns a random id to be passed back by the upload_conflict dialog
+func (db *pendingDB) add(user, dir string, u upFile) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	db.Lock()
+	defer db.Unlock()
+	for i, p := range db.entr {
+		// temp files are purged after a day anyway
+		if time.Since(p.at) > 24*time.Hour {
+			delete(db.entr, i)
+		}
 	}
-	defer f.Close()
+	db.entr[id] = pendingUp{user: user, dir: dir, upFile: u, at: time.Now()}
+	return id
+}
 
-	o, err := os.OpenFile(uDir+"/"+filepath.Base(h.Filename), os.O_RDWR|os.O_CREATE, 0644)
+// take removes and returns uploads of ids that belong to user and dir
+func (db *pendingDB) take(user, dir string, ids []string) []upFile {
+	up := []upFile{}
+	db.Lock()
+	defer db.Unlock()
+	for _, id := range ids {
+		p, ok := db.entr[id]
+		if !ok || p.user != user || p.dir != dir {
+			continue
+		}
+		delete(db.entr, id)
+		fi, err := os.Lstat(p.tmp)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		up = append(up, upFile{name: p.name, tmp: p.tmp, size: fi.Size()})
+	}
+	return up
+}
+
+// formUploads returns uploads waiting for conflict resolution, passed back by the upload_conflict dialog
+func formUploads(uDir, user string, f url.Values) []upFile {
+	return pendingUps.take(user, uDir, f["upid"])
+}
+
+// purgeStaleUploads removes temp files left behind by interrupted or abandoned uploads, copies and moves
+func purgeStaleUploads(uDir string) {
+	d, err := ioutil.ReadDir(uDir)
 	if err != nil {
-		htErr(w, "unable to write file", err)
 		return
 	}
-	defer o.Close()
-	rb := bufio.NewReader(f)
-	wb := bufio.NewWriter(o)
-	bu := make([]byte, 1<<20)
+	for _, f := range d {
+		if time.Since(f.ModTime()) < 24*time.Hour {
+			continue
+		}
+		for _, p := range []string{".wfm-upload-", ".wfm-copy-", ".wfm-move-", ".wfm-save-", ".wfm-link-", ".wfm-archive-"} {
+			if strings.HasPrefix(f.Name(), p) {
+				os.RemoveAll(uDir + "/" + f.Name())
+			}
+		}
+	}
+}
 
-	for {
-		n, err := rb.Read(bu)
-		if err != nil && err != io.EOF {
-			htErr(w, "Unable to write file", err)
-			return
+var errFileExists = fmt.Errorf("file exists")
+
+// placeFile moves tmp to dir/name according to conflict policy and returns the final name
+func placeFile(tmp, dir, name, policy string) (string, error) {
+	fp := dir + "/" + name
+	switch policy {
+	case "overwrite":
+		err := saveVersion(fp, "upload")
+		if err != nil {
+			log.Printf("unable to save version of %v: %v", fp, err)
 		}
-		if n == 0 {
-			break
+		return name, os.Rename(tmp, fp)
+	case "backup":
+		_, err := os.Lstat(fp)
+		if err == nil {
+			err = os.Rename(fp, backupName(fp))
+			if err != nil {
+				return name, err
+			}
+		}
+		return name, os.Rename(tmp, fp)
+	case "skip":
+		os.Remove(tmp)
+		return name, fmt.Errorf("skipped, file exists")
+	case "rename":
+		for i := 1; ; i++ {
+			err := renameNoClobber(tmp, fp)
+			if !os.IsExist(err) {
+				return strings.TrimPrefix(strings.TrimPrefix(fp, dir), "/"), err
+			}
+			fp = numberedName(dir+"/"+name, i)
+		}
+	default:
+		err := renameNoClobber(tmp, fp)
+		if os.IsExist(err) {
+			return name, errFileExists
+		}
+		return name, err
+	}
+}
+
+// renameNoClobber renames src to dst only if dst doesn't exist
+func renameNoClobber(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	}
+	if os.IsExist(err) {
+		return err
+	}
+	// filesystem doesn't support hard links
+	_, err = os.Lstat(dst)
+	if err == nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: os.ErrExist}
+	}
+	return os.Rename(src, dst)
+}
+
+// numberedName returns "name (i).ext" for path fp
+func numberedName(fp string, i int) string {
+	b := filepath.Base(fp)
+	e := filepath.Ext(b)
+	if strings.HasSuffix(strings.TrimSuffix(b, e), ".tar") {
+		e = ".tar" + e
+	}
+	if e == b {
+		e = ""
+	}
+	return filepath.Dir(fp) + "/" + strings.TrimSuffix(b, e) + fmt.Sprintf(" (%d)", i) + e
+}
+
+// backupName returns next free GNU style numbered backup name "file.~N~"
+func backupName(fp string) string {
+	for i := 1; ; i++ {
+		b := fmt.Sprintf("%v.~%d~", fp, i)
+		_, err := os.Lstat(b)
+		if err != nil {
+			return b
+		}
+	}
+}
+
+// checkFree returns an error if writing size bytes would leave less than min_free on the filesystem
+func checkFree(uDir string, size int64) error {
+	fs, err := diskStat(uDir)
+	if err == errNoStatfs {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fr := fs.avail
+	need := uint64(minFree)
+	if size > 0 {
+		need += uint64(size)
+	}
+	if fr < need {
+		return fmt.Errorf("not enough free space on filesystem (%v free)", humanize.Bytes(fr))
+	}
+	return nil
+}
+
+// placeUploads moves uploaded temp files in to place, returns true if policy is ask
+// and some files are kept waiting for conflict resolution
+func placeUploads(uDir string, up []upFile, policy string) bool {
+	go purgeStaleUploads(uDir)
+	conflict := false
+	for i, u := range up {
+		if u.err != nil {
+			continue
+		}
+		fp := uDir + "/" + u.name
+		if deniedPfx(fp) {
+			up[i].err = fmt.Errorf("forbidden")
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(fp), 0755)
+		if err != nil {
+			up[i].err = err
+			continue
+		}
+		if policy == "ask" {
+			_, err = os.Lstat(fp)
+			if err == nil {
+				up[i].keep = true
+				conflict = true
+				continue
+			}
+		}
+		up[i].name, up[i].err = placeFile(u.tmp, uDir, u.name, policy)
+		if up[i].err != nil {
+			continue
 		}
-		wb.Write(bu[:n])
+		log.Printf("Uploaded Dir=%v File=%v Size=%v Policy=%v", uDir, up[i].name, u.size, policy)
 	}
-	wb.Flush()
-	log.Printf("Uploaded Dir=%v File=%v Size=%v", uDir, h.Filename, h.Size)
-	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort+"&hi="+url.QueryEscape(h.Filename))
+	return conflict
 }
 
-func saveText(w http.ResponseWriter, uDir, eSort, uFilePath, uData string, rw bool) {
+func uploadFile(w http.ResponseWriter, uDir, eSort string, up []upFile, policy, user string, rw bool) {
 	if !rw {
 		htErr(w, "permission", fmt.Errorf("read only"))
 		return
@@ -177,33 +507,132 @@ func saveText(w http.ResponseWriter, uDir, eSort, uFilePath, uData string, rw bo
 		htErr(w, "access", fmt.Errorf("forbidden"))
 		return
 	}
+	if len(up) == 0 {
+		htErr(w, "upload", fmt.Errorf("no file selected"))
+		return
+	}
+	if placeUploads(uDir, up, policy) {
+		uploadConflict(w, uDir, eSort, user, up)
+		return
+	}
+	if len(up) == 1 && up[0].err == nil {
+		redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort+"&hi="+url.QueryEscape(up[0].name))
+		return
+	}
+	uploadSummary(w, uDir, eSort, up)
+}
+
+func saveText(w http.ResponseWriter, uDir, eSort, uFilePath, uData, uMtime, uHash, user string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if deniedPfx(uDir) || deniedPfx(uFilePath) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
 	if uData == "" {
 		htErr(w, "text save", fmt.Errorf("zero lenght data"))
 		return
 	}
-	err := ioutil.WriteFile(uFilePath+".tmp", []byte(uData), 0644)
-	if err != nil {
-		htErr(w, "text save", err)
+	// follow symlinks to replace the target instead of the link
+	fp := uFilePath
+	t, err := filepath.EvalSymlinks(uFilePath)
+	if err == nil {
+		fp = t
+	}
+	if deniedPfx(fp) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
 		return
 	}
-	f, err := os.Stat(uFilePath + ".tmp")
+	defer edLocks.saving(fp)()
+	// refuse to overwrite changes made since the file was opened in editor
+	fi, err := os.Stat(uFilePath)
+	if err == nil && uHash != "" && fmt.Sprint(fi.ModTime().UnixNano()) != uMtime {
+		cur, err := ioutil.ReadFile(uFilePath)
+		if err != nil {
+			htErr(w, "text save", err)
+			return
+		}
+		if textHash(cur) != uHash {
+			log.Printf("Edit conflict Dir=%v File=%v user=%v", uDir, uFilePath, user)
+			editConflict(w, uFilePath, eSort, uData, cur, fi)
+			return
+		}
+	}
+	tmp, err := writeTemp(fp, strings.NewReader(uData))
 	if err != nil {
 		htErr(w, "text save", err)
 		return
 	}
-	if f.Size() != int64(len(uData)) {
-		htErr(w, "text save", fmt.Errorf("temp file size != input size"))
-		return
+	defer os.Remove(tmp)
+	err = saveVersion(uFilePath, "edit")
+	if err != nil {
+		log.Printf("unable to save version of %v: %v", uFilePath, err)
 	}
-	err = os.Rename(uFilePath+".tmp", uFilePath)
+	err = os.Rename(tmp, fp)
 	if err != nil {
 		htErr(w, "text save", err)
 		return
 	}
+	err = syncDir(filepath.Dir(fp))
+	if err != nil {
+		log.Printf("unable to sync directory of %v: %v", fp, err)
+	}
 	log.Printf("Saved Text Dir=%v File=%v Size=%v", uDir, uFilePath, len(uData))
+	edLocks.release(uFilePath, user)
 	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort+"&hi="+url.QueryEscape(filepath.Base(uFilePath)))
 }
 
+// writeTemp writes r to a uniquely named temp file next to fp with mode, ownership
+// and extended attributes of the existing fp, synced to disk and ready to be renamed over fp
+func writeTemp(fp string, r io.Reader) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(fp), ".wfm-save-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	m := os.FileMode(0644)
+	fi, sErr := os.Stat(fp)
+	if err == nil && sErr == nil {
+		m = fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			// works for root or for a group the user is member of, chmod must follow
+			f.Chown(int(st.Uid), int(st.Gid))
+		}
+		copyXattrs(fp, f.Name())
+	}
+	if err == nil {
+		err = f.Chmod(m)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	cErr := f.Close()
+	if err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func textHash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
 func mkdir(w http.ResponseWriter, uDir, uNewd, eSort string, rw bool) {
 	if !rw {
 		htErr(w, "permission", fmt.Errorf("read only"))
@@ -280,7 +709,7 @@ func mkurl(w http.ResponseWriter, uDir, uNewu, eUrl, eSort string, rw bool) {
 	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort+"&hi="+url.QueryEscape(fB))
 }
 
-func renFile(w http.ResponseWriter, uDir, uBn, uNewf, eSort string, rw bool) {
+func renFile(w http.ResponseWriter, uDir, uBn, uNewf, eSort, user string, rw bool) {
 	if !rw {
 		htErr(w, "permission", fmt.Errorf("read only"))
 		return
@@ -295,18 +724,13 @@ func renFile(w http.ResponseWriter, uDir, uBn, uNewf, eSort string, rw bool) {
 		return
 	}
 	fB := filepath.Base(uNewf)
-	err := os.Rename(
-		uDir+"/"+uBn,
-		uDir+"/"+fB,
-	)
-	if err != nil {
-		htErr(w, "rename", err)
-		return
-	}
-	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort+"&hi="+url.QueryEscape(fB))
+	j := jobs.start(user, fmt.Sprintf("rename %v to %v in %v", uBn, fB, uDir), func(ctx context.Context, j *job) error {
+		return movePath(ctx, j, uDir+"/"+uBn, uDir+"/"+fB)
+	})
+	jobRedirect(w, j, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort+"&hi="+url.QueryEscape(fB), uDir, eSort)
 }
 
-func moveFiles(w http.ResponseWriter, uDir string, uFilePaths []string, uDst, eSort string, rw bool) {
+func moveFiles(w http.ResponseWriter, uDir string, uFilePaths []string, uDst, eSort, user string, rw bool) {
 	if !rw {
 		htErr(w, "permission", fmt.Errorf("read only"))
 		return
@@ -318,21 +742,25 @@ func moveFiles(w http.ResponseWriter, uDir string, uFilePaths []string, uDst, eS
 
 	lF := ""
 	for _, f := range uFilePaths {
-		fb := filepath.Base(f)
-		err := os.Rename(
-			uDir+"/"+fb,
-			filepath.Clean(uDst+"/"+fb),
-		)
-		if err != nil {
-			htErr(w, "move", err)
-			return
+		lF = filepath.Base(f)
+	}
+	j := jobs.start(user, fmt.Sprintf("move %v from %v to %v", strings.Join(uFilePaths, ", "), uDir, uDst), func(ctx context.Context, j *job) error {
+		for _, f := range uFilePaths {
+			fb := filepath.Base(f)
+			err := movePath(ctx, j,
+				uDir+"/"+fb,
+				filepath.Clean(uDst+"/"+fb),
+			)
+			if err != nil {
+				return err
+			}
 		}
-		lF = fb
-	}
-	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDst)+"&sort="+eSort+"&hi="+url.QueryEscape(lF))
+		return nil
+	})
+	jobRedirect(w, j, *wfmPfx+"?dir="+url.QueryEscape(uDst)+"&sort="+eSort+"&hi="+url.QueryEscape(lF), uDir, eSort)
 }
 
-func deleteFiles(w http.ResponseWriter, uDir string, uFilePaths []string, eSort string, rw bool) {
+func deleteFiles(w http.ResponseWriter, uDir string, uFilePaths []string, eSort, user string, rw bool) {
 	if !rw {
 		htErr(w, "permission", fmt.Errorf("read only"))
 		return
@@ -342,12 +770,25 @@ func deleteFiles(w http.ResponseWriter, uDir string, uFilePaths []string, eSort
 		return
 	}
 
-	for _, f := range uFilePaths {
-		err := os.RemoveAll(uDir + "/" + filepath.Base(f))
-		if err != nil {
-			htErr(w, "delete", err)
-			return
+	if *hardDelete {
+		for _, f := range uFilePaths {
+			err := os.RemoveAll(uDir + "/" + filepath.Base(f))
+			if err != nil {
+				htErr(w, "delete", err)
+				return
+			}
 		}
+		redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort)
+		return
 	}
-	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort)
+	j := jobs.start(user, fmt.Sprintf("move %v from %v to trash", strings.Join(uFilePaths, ", "), uDir), func(ctx context.Context, j *job) error {
+		for _, f := range uFilePaths {
+			err := trashFile(ctx, j, filepath.Clean(uDir+"/"+filepath.Base(f)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	jobRedirect(w, j, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort, uDir, eSort)
 }
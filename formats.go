@@ -11,7 +11,6 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"syscall"
 
 	ico "github.com/biessek/golang-ico"
 	"github.com/bodgit/sevenzip"
@@ -40,7 +39,7 @@ func genFavIcon() *image.NRGBA {
 		Dst:  i,
 		Src:  image.NewUniform(color.RGBA{0, 64, 128, 255}),
 		Face: inconsolata.Bold8x16,
-		Dot:  fixed.Point26_6{fixed.Int26_6(4 * 64), fixed.Int26_6(13 * 64)},
+		Dot:  fixed.Point26_6{X: fixed.Int26_6(4 * 64), Y: fixed.Int26_6(13 * 64)},
 	}
 	d.DrawString("W")
 	return i
@@ -179,34 +178,3 @@ func listArchive(w http.ResponseWriter, fp string) {
 		fmt.Fprintln(w, err)
 	}
 }
-
-func du() {
-	rf, err := os.Stat("/")
-	if err != nil {
-		log.Fatal(err)
-	}
-	rdev := rf.Sys().(*syscall.Stat_t).Dev
-	f := os.DirFS("/")
-	err = fs.WalkDir(f, ".", func(p string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return fs.SkipDir
-		}
-		i, err := d.Info()
-		if err != nil {
-			return fs.SkipDir
-		}
-		sys := i.Sys()
-		if sys == nil {
-			return fs.SkipDir
-		}
-		dev := sys.(*syscall.Stat_t).Dev
-		fmt.Printf("p=%v size=%v dev=%v\n", p, i.Size(), dev)
-		if dev != rdev {
-			return fs.SkipDir
-		}
-		return nil
-	})
-	if err != nil {
-		log.Print(err)
-	}
-}
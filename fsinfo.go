@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dustin/go-humanize"
+)
+
+var errNoStatfs = errors.New("filesystem statistics are not supported on this system")
+
+// fsStat is filesystem capacity in bytes and inodes, avail is free space
+// usable by unprivileged users, free includes space reserved for root
+type fsStat struct {
+	total uint64
+	free  uint64
+	avail uint64
+	files uint64
+	ffree uint64
+}
+
+// usedPct returns percentage of used space the way df calculates it
+func (s fsStat) usedPct() uint64 {
+	u := s.total - s.free
+	d := u + s.avail
+	if d == 0 {
+		return 0
+	}
+	return (u*100 + d - 1) / d
+}
+
+// fsInfo returns capacity line for the listing footer, highlighted when the
+// filesystem is above fs_warn percent full or below min_free
+func fsInfo(uDir string) string {
+	s, err := diskStat(uDir)
+	if err != nil {
+		return ""
+	}
+	o := fmt.Sprintf("Filesystem %v, %v used, %v free (%v%% used)",
+		humanize.Bytes(s.total), humanize.Bytes(s.total-s.free), humanize.Bytes(s.avail), s.usedPct())
+	if s.files > 0 {
+		o += fmt.Sprintf(", %v%% inodes used", (s.files-s.ffree)*100/s.files)
+	}
+	if mountPoint(uDir) {
+		o += ", mount point"
+	}
+	warn := s.usedPct() >= uint64(*fsWarn) || (minFree > 0 && s.avail < uint64(minFree))
+	if s.files > 0 && (s.files-s.ffree)*100/s.files >= uint64(*fsWarn) {
+		warn = true
+	}
+	if warn {
+		return `<FONT COLOR="#CC0000"><B>` + o + `</B></FONT>`
+	}
+	return o
+}
+
+// mountPoint reports whether uDir is on a different filesystem than its parent
+func mountPoint(uDir string) bool {
+	uDir = filepath.Clean(uDir)
+	if uDir == "/" {
+		return false
+	}
+	a, err := os.Stat(uDir)
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(filepath.Dir(uDir))
+	if err != nil {
+		return false
+	}
+	return devNo(a) != devNo(b)
+}
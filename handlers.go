@@ -1,30 +1,32 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"path/filepath"
 	"strings"
 )
 
 func wfm(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(10 << 20)
 	user, rw := auth(w, r)
 	if user == "" {
 		return
 	}
+	up, err := readForm(r, rw, "", -1)
+	defer cleanUploads(up)
+	if err != nil {
+		htErr(w, "form", err)
+		return
+	}
 	go log.Printf("req from=%q user=%q uri=%q form=%v", r.RemoteAddr, user, r.RequestURI, noText(r.Form))
 	modern := false
 	if strings.HasPrefix(r.UserAgent(), "Mozilla/5") {
 		modern = true
 	}
 
-	uDir := filepath.Clean(r.FormValue("dir"))
-	if uDir == "" || uDir == "." {
-		uDir = "/"
-	}
-	eSort := url.QueryEscape(r.FormValue("sort"))
+	uDir := cleanDir(r.FormValue("dir"))
+	eSort := viewQuery(r.FormValue("sort"), r.FormValue("flt"))
 	uFp := filepath.Clean(r.FormValue("fp"))
 	uBn := filepath.Base(r.FormValue("file"))
 	hi := filepath.Base(r.FormValue("hi"))
@@ -40,75 +42,227 @@ func wfm(w http.ResponseWriter, r *http.Request) {
 	case r.FormValue("mkb") != "":
 		prompt(w, uDir, "", eSort, "mkurl", nil)
 		return
+	case r.FormValue("mksl") != "":
+		prompt(w, uDir, "", eSort, "mksymlink", nil)
+		return
+	case r.FormValue("mhlinkp") != "":
+		prompt(w, uDir, "", eSort, "multi_hardlink", r.Form["mulf"])
+		return
 	case r.FormValue("mdelp") != "":
 		prompt(w, uDir, "", eSort, "multi_delete", r.Form["mulf"])
 		return
 	case r.FormValue("mmovp") != "":
 		prompt(w, uDir, "", eSort, "multi_move", r.Form["mulf"])
 		return
+	case r.FormValue("emptyp") != "":
+		prompt(w, uDir, "", eSort, "empty_trash", nil)
+		return
+	case r.FormValue("mcopyp") != "":
+		prompt(w, uDir, "", eSort, "multi_copy", r.Form["mulf"])
+		return
+	case r.FormValue("mpropp") != "":
+		prompt(w, uDir, "", eSort, "multi_props", r.Form["mulf"])
+		return
+	case r.FormValue("mdownp") != "":
+		prompt(w, uDir, "", eSort, "multi_download", r.Form["mulf"])
+		return
+	case r.FormValue("mcompp") != "":
+		prompt(w, uDir, "", eSort, "multi_compress", r.Form["mulf"])
+		return
+	case r.FormValue("filter") != "":
+		setFilter(w, uDir, r.FormValue("sort"), r.FormValue("fltpat"), r.FormValue("finv") != "")
+		return
+	case r.FormValue("selall") != "":
+		listFiles(w, uDir, eSort, hi, user, modern, true)
+		return
+	case r.FormValue("search") != "":
+		searchFiles(w, r, uDir, eSort, modern)
+		return
+	case r.FormValue("ftsearch") != "":
+		contentSearch(w, r, uDir, eSort)
+		return
+	case r.FormValue("dupscan") != "":
+		findDups(w, uDir, eSort, user)
+		return
 	case r.FormValue("upload") != "":
-		f, h, err := r.FormFile("filename")
-		if err != nil {
-			htErr(w, "upload", err)
-			return
-		}
-		uploadFile(w, uDir, eSort, h, f, rw)
+		uploadFile(w, uDir, eSort, up, *upConflict, user, rw)
 		return
 	case r.FormValue("save") != "":
-		saveText(w, uDir, eSort, uFp, r.FormValue("text"), rw)
+		saveText(w, uDir, eSort, uFp, r.FormValue("text"), r.FormValue("mtime"), r.FormValue("hash"), user, rw)
 		return
 	case r.FormValue("home") != "":
-		listFiles(w, "/", eSort, user, hi, modern)
+		listFiles(w, "/", eSort, user, hi, modern, false)
 		return
 	case r.FormValue("up") != "":
-		listFiles(w, filepath.Dir(uDir), eSort, hi, user, modern)
+		listFiles(w, filepath.Dir(uDir), eSort, hi, user, modern, false)
 		return
 	case r.FormValue("cancel") != "":
-		listFiles(w, uDir, eSort, user, hi, modern)
+		cleanUploads(formUploads(uDir, user, r.Form))
+		edLocks.release(uFp, user)
+		listFiles(w, uDir, eSort, user, hi, modern, false)
 		return
 	}
 
 	// form action
 	switch r.FormValue("fn") {
 	case "disp":
-		dispFile(w, uFp)
+		dispFile(w, r, uFp)
 	case "down":
-		downFile(w, uFp)
+		downFile(w, r, uFp)
 	case "edit":
-		editText(w, uFp, eSort)
+		editText(w, uFp, eSort, user)
+	case "upload_conflict":
+		uploadFile(w, uDir, eSort, formUploads(uDir, user, r.Form), conflictChoice(r.FormValue("policy")), user, rw)
 	case "mkdir":
 		mkdir(w, uDir, uBn, eSort, rw)
 	case "mkfile":
 		mkfile(w, uDir, uBn, eSort, rw)
 	case "mkurl":
 		mkurl(w, uDir, uBn, r.FormValue("url"), eSort, rw)
+	case "mksymlink":
+		mksymlink(w, uDir, uBn, r.FormValue("target"), eSort, rw)
+	case "retargetp":
+		prompt(w, uDir, uBn, eSort, "retarget", nil)
+	case "retarget":
+		retarget(w, uDir, uBn, r.FormValue("target"), eSort, rw)
+	case "multi_hardlink":
+		log.Printf("multi_hardlink dir=%v files=%+v dest=%v user=%v@%v", uDir, r.Form["mulf"], r.FormValue("dst"), user, r.RemoteAddr)
+		hardLinks(w, uDir, r.Form["mulf"], r.FormValue("dst"), eSort, rw)
 	case "rename":
-		renFile(w, uDir, uBn, r.FormValue("dst"), eSort, rw)
+		renFile(w, uDir, uBn, r.FormValue("dst"), eSort, user, rw)
 	case "renp":
 		prompt(w, uDir, r.FormValue("oldf"), eSort, "rename", nil)
 	case "movp":
 		prompt(w, uDir, uBn, eSort, "move", nil)
+	case "copyp":
+		prompt(w, uDir, uBn, eSort, "copy", nil)
+	case "extractp":
+		prompt(w, uDir, uBn, eSort, "extract", nil)
+	case "propp":
+		if !rw {
+			prompt(w, uDir, uBn, eSort, "info", nil)
+			return
+		}
+		prompt(w, uDir, uBn, eSort, "props", nil)
 	case "delp":
 		prompt(w, uDir, uBn, eSort, "delete", nil)
+	case "sharep":
+		prompt(w, uDir, uBn, eSort, "share", nil)
+	case "share":
+		mkShare(w, r, uDir, uBn, eSort, user, rw)
+	case "shares":
+		listShares(w, r, uDir, eSort, user, "")
+	case "unshare":
+		rmShare(w, r, uDir, eSort, user)
+	case "downp":
+		prompt(w, uDir, uBn, eSort, "download", nil)
+	case "download":
+		log.Printf("download dir=%v file=%v user=%v@%v", uDir, uBn, user, r.RemoteAddr)
+		downArchive(w, uDir, []string{uBn}, r.FormValue("format"), "")
+	case "multi_download":
+		log.Printf("multi_download dir=%v files=%+v user=%v@%v", uDir, r.Form["mulf"], user, r.RemoteAddr)
+		downArchive(w, uDir, r.Form["mulf"], r.FormValue("format"), "")
+	case "multi_compress":
+		log.Printf("multi_compress dir=%v files=%+v dest=%v format=%v user=%v@%v", uDir, r.Form["mulf"], r.FormValue("dst"), r.FormValue("format"), user, r.RemoteAddr)
+		compressFiles(w, uDir, r.Form["mulf"], r.FormValue("dst"), uBn, r.FormValue("format"), r.FormValue("level"), eSort, user, rw)
 	case "move":
 		log.Printf("move dir=%v file=%v user=%v@%v", uDir, uFp, user, r.RemoteAddr)
-		moveFiles(w, uDir, []string{uBn}, r.FormValue("dst"), eSort, rw)
+		moveFiles(w, uDir, []string{uBn}, r.FormValue("dst"), eSort, user, rw)
 	case "delete":
 		log.Printf("delete dir=%v file=%v user=%v@%v", uDir, uBn, user, r.RemoteAddr)
-		deleteFiles(w, uDir, []string{uBn}, eSort, rw)
+		deleteFiles(w, uDir, []string{uBn}, eSort, user, rw)
 	case "multi_delete":
 		log.Printf("multi_delete dir=%v files=%+v user=%v@%v", uDir, r.Form["mulf"], user, r.RemoteAddr)
-		deleteFiles(w, uDir, r.Form["mulf"], eSort, rw)
+		deleteFiles(w, uDir, r.Form["mulf"], eSort, user, rw)
 	case "multi_move":
 		log.Printf("multi_move dir=%v files=%+v dest=%v user=%v@%v", uDir, r.Form["mulf"], r.FormValue("dst"), user, r.RemoteAddr)
-		moveFiles(w, uDir, r.Form["mulf"], r.FormValue("dst"), eSort, rw)
+		moveFiles(w, uDir, r.Form["mulf"], r.FormValue("dst"), eSort, user, rw)
+	case "copy":
+		log.Printf("copy dir=%v file=%v dest=%v user=%v@%v", uDir, uBn, r.FormValue("dst"), user, r.RemoteAddr)
+		copyFiles(w, uDir, []string{uBn}, r.FormValue("dst"), r.FormValue("policy"), eSort, user, rw)
+	case "multi_copy":
+		log.Printf("multi_copy dir=%v files=%+v dest=%v user=%v@%v", uDir, r.Form["mulf"], r.FormValue("dst"), user, r.RemoteAddr)
+		copyFiles(w, uDir, r.Form["mulf"], r.FormValue("dst"), r.FormValue("policy"), eSort, user, rw)
+	case "extract":
+		log.Printf("extract dir=%v file=%v dest=%v user=%v@%v", uDir, uBn, r.FormValue("dst"), user, r.RemoteAddr)
+		extractArchive(w, uDir, uBn, r.FormValue("dst"), r.FormValue("sub") != "", r.FormValue("policy"), eSort, user, rw)
+	case "props":
+		log.Printf("props dir=%v file=%v user=%v@%v", uDir, uBn, user, r.RemoteAddr)
+		setProps(w, r, uDir, []string{uBn}, eSort, user, rw)
+	case "multi_props":
+		log.Printf("multi_props dir=%v files=%+v user=%v@%v", uDir, r.Form["mulf"], user, r.RemoteAddr)
+		setProps(w, r, uDir, r.Form["mulf"], eSort, user, rw)
+	case "trash":
+		listTrash(w, uDir, eSort, rw)
+	case "restore":
+		log.Printf("restore from trash file=%v user=%v@%v", uBn, user, r.RemoteAddr)
+		restoreTrash(w, uDir, r.FormValue("trash"), uBn, eSort, user, rw)
+	case "purgep":
+		if !rw {
+			htErr(w, "permission", fmt.Errorf("read only"))
+			return
+		}
+		prompt(w, uDir, uBn, eSort, "purge", []string{r.FormValue("trash")})
+	case "purge":
+		log.Printf("purge from trash file=%v user=%v@%v", uBn, user, r.RemoteAddr)
+		purgeTrash(w, uDir, r.FormValue("trash"), uBn, eSort, rw)
+	case "empty_trash":
+		log.Printf("empty trash user=%v@%v", user, r.RemoteAddr)
+		purgeTrash(w, uDir, "", "", eSort, rw)
+	case "history":
+		listHistory(w, uFp, eSort)
+	case "verview":
+		viewVersion(w, r, uFp, r.FormValue("v"), false)
+	case "verdown":
+		viewVersion(w, r, uFp, r.FormValue("v"), true)
+	case "verdiff":
+		diffVersion(w, uFp, r.FormValue("v"), eSort)
+	case "verrestp":
+		prompt(w, filepath.Dir(uFp), filepath.Base(uFp), eSort, "restore_version", []string{r.FormValue("v")})
+	case "restore_version":
+		log.Printf("restore version dir=%v file=%v version=%v user=%v@%v", uDir, uBn, r.FormValue("v"), user, r.RemoteAddr)
+		restoreVersion(w, uDir+"/"+uBn, r.FormValue("v"), eSort, rw)
+	case "du":
+		diskUsage(w, uDir, eSort)
+	case "dups":
+		listDups(w, uDir, eSort, user, rw)
+	case "dupact":
+		log.Printf("duplicates dir=%v files=%+v link=%v user=%v@%v", uDir, r.Form["dupf"], r.FormValue("duplink") != "", user, r.RemoteAddr)
+		dupAction(w, r, uDir, eSort, user, rw)
+	case "sum":
+		showSums(w, uFp, r.FormValue("expect"), eSort, user)
+	case "sumall":
+		log.Printf("verify checksums dir=%v user=%v@%v", uDir, user, r.RemoteAddr)
+		verifyAll(w, uDir, eSort, user)
+	case "sumreport":
+		sumReportPage(w, uDir, eSort)
+	case "jobs":
+		listJobs(w, uDir, eSort, user)
+	case "jobcancel":
+		cancelJob(w, r, uDir, eSort, user)
 	case "logout":
 		logout(w)
 	case "about":
 		about(w, uDir, eSort, r.UserAgent())
 	default:
-		listFiles(w, uDir, eSort, hi, user, modern)
+		listFiles(w, uDir, eSort, hi, user, modern, false)
+	}
+}
+
+func conflictChoice(p string) string {
+	switch p {
+	case "overwrite", "rename", "backup", "skip":
+		return p
+	}
+	return "skip"
+}
+
+func cleanDir(d string) string {
+	d = filepath.Clean(d)
+	if d == "" || d == "." {
+		return "/"
 	}
+	return d
 }
 
 func favicon(w http.ResponseWriter, r *http.Request) {
@@ -118,7 +272,7 @@ func favicon(w http.ResponseWriter, r *http.Request) {
 func noText(m map[string][]string) map[string][]string {
 	o := make(map[string][]string)
 	for k, v := range m {
-		if k == "text" {
+		if k == "text" || k == "password" {
 			continue
 		}
 		o[k] = v
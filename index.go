@@ -0,0 +1,414 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the content index keeps sorted list of words for every text file, it's
+// updated by periodic rescans which only read files with changed size or mtime
+
+var (
+	ftIndex = newFtIndex()
+)
+
+type ftDoc struct {
+	Size  int64
+	Mtime time.Time
+	Words []string // nil for files which are not text
+}
+
+type ftIdx struct {
+	docs  map[string]*ftDoc
+	saved time.Time
+	sync.Mutex
+}
+
+func newFtIndex() *ftIdx {
+	x := new(ftIdx)
+	x.docs = make(map[string]*ftDoc)
+	return x
+}
+
+func (x *ftIdx) file() string {
+	return *idxDir + "/index.gob"
+}
+
+// load reads the index saved by the server or by "wfm index" if it's newer than ours
+func (x *ftIdx) load() error {
+	fi, err := os.Stat(x.file())
+	if err != nil {
+		return err
+	}
+	x.Lock()
+	defer x.Unlock()
+	if fi.ModTime().Equal(x.saved) {
+		return nil
+	}
+	f, err := os.Open(x.file())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d := make(map[string]*ftDoc)
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&d)
+	if err != nil {
+		return err
+	}
+	x.docs = d
+	x.saved = fi.ModTime()
+	return nil
+}
+
+// save writes the index, unless another process saved one since it was last
+// loaded or saved, then that one is loaded instead and updated by the next scan
+func (x *ftIdx) save() error {
+	fi, err := os.Stat(x.file())
+	x.Lock()
+	sv := x.saved
+	x.Unlock()
+	if err == nil && !fi.ModTime().Equal(sv) && x.load() == nil {
+		log.Printf("index: loaded %v saved by another process", x.file())
+		return nil
+	}
+	err = os.MkdirAll(*idxDir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(*idxDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	x.Lock()
+	defer x.Unlock()
+	b := bufio.NewWriter(f)
+	err = gob.NewEncoder(b).Encode(x.docs)
+	if err == nil {
+		err = b.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), x.file())
+	if err != nil {
+		return err
+	}
+	fi, err = os.Stat(x.file())
+	if err == nil {
+		x.saved = fi.ModTime()
+	}
+	return nil
+}
+
+// scan walks index_root, re-reads changed files and drops removed ones
+func (x *ftIdx) scan() {
+	t := time.Now()
+	seen := make(map[string]bool)
+	n := 0
+	filepath.Walk(*idxRoot, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if deniedPfx(p) || (!*showDot && p != *idxRoot && strings.HasPrefix(fi.Name(), ".")) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || fi.Size() == 0 || fi.Size() > int64(idxMax) {
+			return nil
+		}
+		seen[p] = true
+		x.Lock()
+		d, ok := x.docs[p]
+		x.Unlock()
+		if ok && d.Size == fi.Size() && d.Mtime.Equal(fi.ModTime()) {
+			return nil
+		}
+		d = &ftDoc{Size: fi.Size(), Mtime: fi.ModTime()}
+		txt, err := extractText(p)
+		if err == nil {
+			d.Words = words(txt)
+		}
+		n++
+		x.Lock()
+		x.docs[p] = d
+		x.Unlock()
+		return nil
+	})
+	x.Lock()
+	for p := range x.docs {
+		if !seen[p] {
+			delete(x.docs, p)
+			n++
+		}
+	}
+	l := len(x.docs)
+	x.Unlock()
+	if n == 0 {
+		return
+	}
+	err := x.save()
+	if err != nil {
+		log.Printf("index: unable to save: %v", err)
+		return
+	}
+	log.Printf("index: %v files, %v changed, scan took %v", l, n, time.Since(t))
+}
+
+// run keeps the index up to date, picking up indexes rebuilt by "wfm index"
+func (x *ftIdx) run() {
+	for {
+		err := x.load()
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("index: unable to load: %v", err)
+		}
+		x.scan()
+		time.Sleep(*idxRescan)
+	}
+}
+
+// rebuild creates a new index from scratch, for the index subcommand
+func (x *ftIdx) rebuild() {
+	if fi, err := os.Stat(x.file()); err == nil {
+		x.saved = fi.ModTime()
+	}
+	x.scan()
+	if len(x.docs) == 0 {
+		err := x.save()
+		if err != nil {
+			log.Fatalf("index: unable to save: %v", err)
+		}
+	}
+}
+
+// find returns paths under uDir of documents containing words starting with all terms
+func (x *ftIdx) find(uDir string, terms []string) []string {
+	pfx := strings.TrimSuffix(uDir, "/") + "/"
+	l := []string{}
+	x.Lock()
+	defer x.Unlock()
+doc:
+	for p, d := range x.docs {
+		if !strings.HasPrefix(p, pfx) || d.Words == nil {
+			continue
+		}
+		for _, t := range terms {
+			i := sort.SearchStrings(d.Words, t)
+			if i == len(d.Words) || !strings.HasPrefix(d.Words[i], t) {
+				continue doc
+			}
+		}
+		l = append(l, p)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// words returns sorted unique lower case words of text
+func words(txt string) []string {
+	m := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(strings.ToLower(txt), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(w) < 2 || len(w) > 64 {
+			continue
+		}
+		m[w] = true
+	}
+	l := make([]string, 0, len(m))
+	for w := range m {
+		l = append(l, w)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// extractText returns text of plain text files and of office documents
+func extractText(fp string) (string, error) {
+	switch strings.ToLower(filepath.Ext(fp)) {
+	case ".docx":
+		return zipText(fp, func(n string) bool { return n == "word/document.xml" })
+	case ".xlsx":
+		return zipText(fp, func(n string) bool { return n == "xl/sharedStrings.xml" })
+	case ".pptx":
+		return zipText(fp, func(n string) bool {
+			return strings.HasPrefix(n, "ppt/slides/slide") && strings.HasSuffix(n, ".xml")
+		})
+	case ".odt", ".ods", ".odp":
+		return zipText(fp, func(n string) bool { return n == "content.xml" })
+	}
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(b, 0) != -1 || !utf8.Valid(b) {
+		return "", fmt.Errorf("not a text file")
+	}
+	return string(b), nil
+}
+
+// zipText extracts character data from xml members of zip based office files,
+// paragraphs and rows end up on separate lines
+func zipText(fp string, member func(string) bool) (string, error) {
+	z, err := zip.OpenReader(fp)
+	if err != nil {
+		return "", err
+	}
+	defer z.Close()
+	o := strings.Builder{}
+	for _, f := range z.File {
+		if !member(f.Name) {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		d := xml.NewDecoder(io.LimitReader(r, int64(idxMax)))
+		for {
+			t, err := d.Token()
+			if err != nil {
+				break
+			}
+			switch e := t.(type) {
+			case xml.CharData:
+				o.Write(e)
+			case xml.EndElement:
+				switch e.Name.Local {
+				case "p", "si", "tr", "table-row", "h":
+					o.WriteString("\n")
+				case "tab", "tc", "table-cell":
+					o.WriteString("\t")
+				}
+			}
+		}
+		r.Close()
+	}
+	return o.String(), nil
+}
+
+// contentSearch shows files under uDir matching all words of the query with matching lines
+func contentSearch(w http.ResponseWriter, r *http.Request, uDir, sort string) {
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	if !*idxOn {
+		htErr(w, "search", fmt.Errorf("content index is disabled"))
+		return
+	}
+	terms := words(r.FormValue("q"))
+	if len(terms) == 0 {
+		htErr(w, "search", fmt.Errorf("enter words to search for"))
+		return
+	}
+	header(w, uDir, sort)
+	searchForm(w, r, uDir)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    `))
+	ctx, cancel := context.WithTimeout(r.Context(), *searchTime)
+	defer cancel()
+	n := 0
+	st := ""
+	for _, p := range ftIndex.find(uDir, terms) {
+		if deniedPfx(p) {
+			continue
+		}
+		if n >= *searchMax {
+			break
+		}
+		if ctx.Err() != nil {
+			st = fmt.Sprintf(", search stopped after %v", *searchTime)
+			break
+		}
+		txt, err := extractText(p)
+		if err != nil {
+			continue
+		}
+		rel, _ := filepath.Rel(uDir, p)
+		fmt.Fprintf(w, `<TR BGCOLOR="%v"><TD><A HREF="%v?fn=disp&amp;fp=%v">%v</A><BR>`+"\n",
+			rowColor(n, false), *wfmPfx, url.QueryEscape(p), html.EscapeString(rel))
+		ctxLines(w, strings.Split(txt, "\n"), terms)
+		fmt.Fprintln(w, `</TD></TR>`)
+		n++
+	}
+	w.Write([]byte(`<TR><TD STYLE="border-top:1px solid grey">` + fmt.Sprint(n) + ` found` + st + `</TD></TR></TABLE>`))
+	footer(w)
+}
+
+// ctxLines writes up to 5 lines containing any of the terms with a line of context around
+func ctxLines(w io.Writer, lines, terms []string) {
+	show := make([]bool, len(lines))
+	hit := make([]bool, len(lines))
+	m := 0
+	for i, l := range lines {
+		if m >= 5 {
+			break
+		}
+		ll := strings.ToLower(l)
+		for _, t := range terms {
+			if !strings.Contains(ll, t) {
+				continue
+			}
+			hit[i] = true
+			for j := i - 1; j <= i+1; j++ {
+				if j >= 0 && j < len(lines) {
+					show[j] = true
+				}
+			}
+			m++
+			break
+		}
+	}
+	fmt.Fprintln(w, `<PRE STYLE="margin:0px 0px 6px 16px">`)
+	gap := false
+	for i, l := range lines {
+		if !show[i] {
+			gap = i > 0
+			continue
+		}
+		if gap {
+			fmt.Fprintln(w, `<FONT COLOR="#808080">...</FONT>`)
+			gap = false
+		}
+		if len(l) > 200 {
+			l = l[:200]
+			for !utf8.ValidString(l) {
+				l = l[:len(l)-1]
+			}
+		}
+		if hit[i] {
+			fmt.Fprintf(w, "<SPAN STYLE=\"background-color:#FFFF99\">%5d: %v</SPAN>\n", i+1, html.EscapeString(l))
+			continue
+		}
+		fmt.Fprintf(w, "%5d: %v\n", i+1, html.EscapeString(l))
+	}
+	fmt.Fprintln(w, `</PRE>`)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	jobs = newJobDB()
+)
+
+// job is a long running file operation executed in background
+type job struct {
+	ID     int
+	User   string
+	Desc   string
+	Start  time.Time
+	End    time.Time
+	Total  int64
+	Done   int64
+	Files  int
+	Err    error
+	Result string
+	cancel context.CancelFunc
+	fin    chan struct{}
+	sync.Mutex
+}
+
+type jobDB struct {
+	entr map[int]*job
+	next int
+	sync.Mutex
+}
+
+func newJobDB() *jobDB {
+	db := new(jobDB)
+	db.entr = make(map[int]*job)
+	return db
+}
+
+// start runs fn in background, finished jobs are kept for a day
+func (db *jobDB) start(user, desc string, fn func(ctx context.Context, j *job) error) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+	db.Lock()
+	db.next++
+	j := &job{
+		ID:     db.next,
+		User:   user,
+		Desc:   desc,
+		Start:  time.Now(),
+		cancel: cancel,
+		fin:    make(chan struct{}),
+	}
+	db.entr[j.ID] = j
+	for id, o := range db.entr {
+		if !o.End.IsZero() && time.Since(o.End) > 24*time.Hour {
+			delete(db.entr, id)
+		}
+	}
+	db.Unlock()
+
+	log.Printf("job %d started user=%v: %v", j.ID, user, desc)
+	go func() {
+		err := fn(ctx, j)
+		cancel()
+		j.Lock()
+		j.Err = err
+		j.End = time.Now()
+		j.Unlock()
+		close(j.fin)
+		log.Printf("job %d finished in %v err=%v: %v", j.ID, time.Since(j.Start), err, desc)
+	}()
+	return j
+}
+
+func (db *jobDB) get(id int, user string) (*job, bool) {
+	db.Lock()
+	defer db.Unlock()
+	j, ok := db.entr[id]
+	if !ok || j.User != user {
+		return nil, false
+	}
+	return j, true
+}
+
+func (db *jobDB) list(user string) []*job {
+	db.Lock()
+	defer db.Unlock()
+	l := []*job{}
+	for _, j := range db.entr {
+		if j.User == user {
+			l = append(l, j)
+		}
+	}
+	sort.Slice(l, func(i, k int) bool {
+		return l[i].ID > l[k].ID
+	})
+	return l
+}
+
+// wait returns true if the job finished within d
+func (j *job) wait(d time.Duration) bool {
+	select {
+	case <-j.fin:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (j *job) progress(bytes int64, files int) {
+	j.Lock()
+	j.Done += bytes
+	j.Files += files
+	j.Unlock()
+}
+
+func (j *job) setTotal(t int64) {
+	j.Lock()
+	j.Total = t
+	j.Unlock()
+}
+
+func (j *job) addTotal(t int64) {
+	j.Lock()
+	j.Total += t
+	j.Unlock()
+}
+
+// jobRedirect waits shortly for the job to finish and either redirects to uUrl or to the jobs page
+func jobRedirect(w http.ResponseWriter, j *job, uUrl, uDir, eSort string) {
+	jobRedirectFunc(w, j, func() string { return uUrl }, uDir, eSort)
+}
+
+// jobRedirectFunc is jobRedirect for jobs which decide where to go when done
+func jobRedirectFunc(w http.ResponseWriter, j *job, uUrl func() string, uDir, eSort string) {
+	if j.wait(2 * time.Second) {
+		if j.Err != nil {
+			htErr(w, j.Desc, j.Err)
+			return
+		}
+		redirect(w, uUrl())
+		return
+	}
+	redirect(w, *wfmPfx+"?fn=jobs&dir="+url.QueryEscape(uDir)+"&sort="+eSort)
+}
+
+func cancelJob(w http.ResponseWriter, r *http.Request, uDir, eSort, user string) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	j, ok := jobs.get(id, user)
+	if !ok {
+		htErr(w, "cancel", fmt.Errorf("job not found"))
+		return
+	}
+	j.cancel()
+	log.Printf("job %d canceled by user=%v@%v", id, user, r.RemoteAddr)
+	redirect(w, *wfmPfx+"?fn=jobs&dir="+url.QueryEscape(uDir)+"&sort="+eSort)
+}
+
+func listJobs(w http.ResponseWriter, uDir, eSort, user string) {
+	l := jobs.list(user)
+	for _, j := range l {
+		j.Lock()
+		r := j.End.IsZero()
+		j.Unlock()
+		if r {
+			w.Header().Set("Refresh", "3")
+			break
+		}
+	}
+	header(w, uDir, eSort)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD COLSPAN="5" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Background jobs of ` + html.EscapeString(user) + `</FONT></TD></TR>
+    <TR BGCOLOR="#A0A0A0">
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Job</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Progress</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Started</FONT></TD>
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Status</FONT></TD>
+    <TD NOWRAP ALIGN="right">&nbsp;</TD>
+    </TR>
+    `))
+	for n, j := range l {
+		j.Lock()
+		bg := "#FFFFFF"
+		if n%2 == 1 {
+			bg = "#F0F0F0"
+		}
+		pr := humanize.Bytes(uint64(j.Done))
+		if j.Total > 0 {
+			pr = fmt.Sprintf("%d%% %v of %v", j.Done*100/j.Total, pr, humanize.Bytes(uint64(j.Total)))
+		}
+		pr += fmt.Sprintf(", %d files", j.Files)
+		st := "running"
+		ac := `<A HREF="` + *wfmPfx + `?fn=jobcancel&amp;id=` + fmt.Sprint(j.ID) + `&amp;dir=` + url.QueryEscape(uDir) + `&amp;sort=` + html.EscapeString(eSort) + `">cancel</A>`
+		switch {
+		case j.End.IsZero():
+		case j.Err != nil:
+			st = `<FONT COLOR="#CC0000">` + html.EscapeString(j.Err.Error()) + `</FONT>`
+			ac = "&nbsp;"
+		default:
+			st = "done in " + j.End.Sub(j.Start).Round(time.Second).String()
+			if j.Result != "" {
+				st += ", " + html.EscapeString(j.Result)
+			}
+			ac = "&nbsp;"
+		}
+		fmt.Fprintf(w, `<TR BGCOLOR="%v"><TD>%v</TD><TD NOWRAP ALIGN="right">%v</TD><TD NOWRAP ALIGN="right">%v</TD><TD>%v</TD><TD NOWRAP ALIGN="right">%v&nbsp;</TD></TR>`+"\n",
+			bg, html.EscapeString(j.Desc), pr, humanize.Time(j.Start), st, ac)
+		j.Unlock()
+	}
+	w.Write([]byte(`
+    </TABLE><P>
+    &nbsp;<INPUT TYPE="SUBMIT" VALUE=" OK " NAME="OK">
+    `))
+	footer(w)
+}
+
+// jobReader reports read progress to job and stops when ctx is canceled
+type jobReader struct {
+	ctx context.Context
+	j   *job
+	r   io.Reader
+}
+
+func (jr *jobReader) Read(p []byte) (int, error) {
+	err := jr.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	n, err := jr.r.Read(p)
+	jr.j.progress(int64(n), 0)
+	return n, err
+}
+
+// treeSize returns total size of regular files under fp, not following symlinks
+func treeSize(ctx context.Context, fp string) int64 {
+	var t int64
+	filepath.Walk(fp, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fi.Mode().IsRegular() {
+			t += fi.Size()
+		}
+		return nil
+	})
+	return t
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// linkTarget resolves symlink target t relative to dir, refusing targets which
+// climb above the root or point in to denied paths, directly or via other links
+func linkTarget(dir, t string) (string, error) {
+	if t == "" {
+		return "", fmt.Errorf("link target is empty")
+	}
+	p := t
+	if !filepath.IsAbs(t) {
+		p = dir + "/" + t
+	}
+	// filepath.Clean would silently turn /.. in to /, so resolve by hand
+	el := []string{}
+	for _, e := range strings.Split(p, "/") {
+		switch e {
+		case "", ".":
+		case "..":
+			if len(el) == 0 {
+				return "", fmt.Errorf("link target is outside of the root")
+			}
+			el = el[:len(el)-1]
+		default:
+			el = append(el, e)
+		}
+	}
+	a := "/" + strings.Join(el, "/")
+	if deniedPfx(a) {
+		return "", fmt.Errorf("link target is forbidden")
+	}
+	// links in the target are followed before "..", which Clean can't know about
+	r, err := realPath(p)
+	if err != nil {
+		return "", err
+	}
+	if deniedPfx(r) {
+		return "", fmt.Errorf("link target is forbidden")
+	}
+	return a, nil
+}
+
+// realPath resolves symlinks in absolute path p component by component like the
+// kernel does, so "link/.." is the parent of the link target, the part of p which
+// doesn't exist is cleaned lexically as it contains no links
+func realPath(p string) (string, error) {
+	cur := "/"
+	el := strings.Split(p, "/")
+	n := 0
+	for len(el) > 0 {
+		e := el[0]
+		el = el[1:]
+		switch e {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			continue
+		}
+		c := filepath.Join(cur, e)
+		fi, err := os.Lstat(c)
+		if err != nil {
+			return filepath.Join(append([]string{c}, el...)...), nil
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			cur = c
+			continue
+		}
+		n++
+		if n > 40 {
+			return "", fmt.Errorf("too many levels of symbolic links")
+		}
+		t, err := os.Readlink(c)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(t) {
+			cur = "/"
+		}
+		el = append(strings.Split(t, "/"), el...)
+	}
+	return cur, nil
+}
+
+// linkValue returns what should be stored in a symlink in dir pointing to t,
+// in a chroot absolute targets are made relative so they also stay inside it
+// when seen from outside
+func linkValue(dir, t, a string) string {
+	if *chrootDir == "" || !filepath.IsAbs(t) {
+		return t
+	}
+	r, err := filepath.Rel(dir, a)
+	if err != nil {
+		return t
+	}
+	return r
+}
+
+func mksymlink(w http.ResponseWriter, uDir, uNewl, uTarget, eSort string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	if uNewl == "" {
+		htErr(w, "symlink", fmt.Errorf("link name is empty"))
+		return
+	}
+	a, err := linkTarget(uDir, uTarget)
+	if err != nil {
+		htErr(w, "symlink", err)
+		return
+	}
+	lB := filepath.Base(uNewl)
+	err = os.Symlink(linkValue(uDir, uTarget, a), uDir+"/"+lB)
+	if err != nil {
+		htErr(w, "symlink", err)
+		return
+	}
+	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort+"&hi="+url.QueryEscape(lB))
+}
+
+// retarget atomically replaces target of an existing symlink
+func retarget(w http.ResponseWriter, uDir, uBn, uTarget, eSort string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	fp := uDir + "/" + uBn
+	if deniedPfx(fp) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	fi, err := os.Lstat(fp)
+	if err != nil {
+		htErr(w, "retarget", err)
+		return
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		htErr(w, "retarget", fmt.Errorf("%v is not a symbolic link", uBn))
+		return
+	}
+	a, err := linkTarget(uDir, uTarget)
+	if err != nil {
+		htErr(w, "retarget", err)
+		return
+	}
+	tmp := fmt.Sprintf("%v/.wfm-link-%d", uDir, time.Now().UnixNano())
+	err = os.Symlink(linkValue(uDir, uTarget, a), tmp)
+	if err != nil {
+		htErr(w, "retarget", err)
+		return
+	}
+	err = os.Rename(tmp, fp)
+	if err != nil {
+		os.Remove(tmp)
+		htErr(w, "retarget", err)
+		return
+	}
+	log.Printf("Retargeted %v to %v", fp, uTarget)
+	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort+"&hi="+url.QueryEscape(uBn))
+}
+
+// hardLinks links regular files uFiles from uDir in to uDst, names taken in the
+// destination get a number appended like copies do
+func hardLinks(w http.ResponseWriter, uDir string, uFiles []string, uDst, eSort string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if deniedPfx(uDir) || deniedPfx(uDst) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	if len(uFiles) == 0 {
+		htErr(w, "hard link", fmt.Errorf("no files selected"))
+		return
+	}
+	lF := ""
+	for _, f := range uFiles {
+		src := uDir + "/" + filepath.Base(f)
+		if deniedPfx(src) {
+			htErr(w, "access", fmt.Errorf("forbidden"))
+			return
+		}
+		fi, err := os.Lstat(src)
+		if err != nil {
+			htErr(w, "hard link", err)
+			return
+		}
+		if !fi.Mode().IsRegular() {
+			htErr(w, "hard link", fmt.Errorf("%v is not a regular file", fi.Name()))
+			return
+		}
+		dst := filepath.Clean(uDst + "/" + fi.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			dst = uniqName(dst)
+		}
+		if deniedPfx(dst) {
+			htErr(w, "access", fmt.Errorf("forbidden"))
+			return
+		}
+		err = os.Link(src, dst)
+		if err != nil {
+			htErr(w, "hard link", err)
+			return
+		}
+		lF = filepath.Base(dst)
+	}
+	redirect(w, *wfmPfx+"?dir="+url.QueryEscape(uDst)+"&sort="+eSort+"&hi="+url.QueryEscape(lF))
+}
+
+// linkInfo returns link icon and target of a symlink for the directory listing,
+// whether it points to a directory and whether it's broken
+func linkInfo(uDir string, f os.FileInfo, i map[string]string, sort string) (string, bool, bool) {
+	if f.Mode()&os.ModeSymlink == 0 {
+		return "", false, false
+	}
+	t, _ := os.Readlink(uDir + "/" + f.Name())
+	rl := `<A HREF="` + *wfmPfx + `?fn=retargetp&amp;dir=` + url.QueryEscape(uDir) + `&amp;file=` + url.QueryEscape(f.Name()) + `&amp;sort=` + html.EscapeString(sort) + `">`
+	ls, err := os.Stat(uDir + "/" + f.Name())
+	if err != nil {
+		return i["li"] + rl + `<FONT SIZE="-1" COLOR="#CC0000">` + html.EscapeString(t) + ` (broken)</FONT></A>`, false, true
+	}
+	return i["li"] + rl + `<FONT SIZE="-1" COLOR="#808080">` + html.EscapeString(t) + `</FONT></A>`, ls.IsDir(), false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	edLocks = newEdLocks()
+)
+
+// edLock is an advisory lock taken when a file is opened in the text editor,
+// it only warns other users, saves are protected by the hash check in saveText
+type edLock struct {
+	user  string
+	since time.Time
+	seen  time.Time
+}
+
+type edLockDB struct {
+	entr  map[string]edLock
+	saves map[string]*saveLock
+	sync.Mutex
+}
+
+// saveLock serializes saves of a file, n counts saves holding or waiting for it
+type saveLock struct {
+	n int
+	sync.Mutex
+}
+
+func newEdLocks() *edLockDB {
+	db := new(edLockDB)
+	db.entr = make(map[string]edLock)
+	db.saves = make(map[string]*saveLock)
+	return db
+}
+
+// take locks fp for user and returns a lock held by someone else, if any
+func (db *edLockDB) take(fp, user string) (edLock, bool) {
+	if *edLockTime == 0 {
+		return edLock{}, false
+	}
+	fp = filepath.Clean(fp)
+	db.Lock()
+	defer db.Unlock()
+	for f, l := range db.entr {
+		if time.Since(l.seen) > *edLockTime {
+			delete(db.entr, f)
+		}
+	}
+	l, ok := db.entr[fp]
+	if ok && l.user != user {
+		return l, true
+	}
+	if !ok {
+		l = edLock{user: user, since: time.Now()}
+	}
+	l.seen = time.Now()
+	db.entr[fp] = l
+	return edLock{}, false
+}
+
+func (db *edLockDB) release(fp, user string) {
+	fp = filepath.Clean(fp)
+	db.Lock()
+	defer db.Unlock()
+	l, ok := db.entr[fp]
+	if ok && l.user == user {
+		delete(db.entr, fp)
+	}
+}
+
+// saving locks fp for the conflict check and replacement of the file done
+// by a save, returns function to unlock it
+func (db *edLockDB) saving(fp string) func() {
+	fp = filepath.Clean(fp)
+	db.Lock()
+	l, ok := db.saves[fp]
+	if !ok {
+		l = new(saveLock)
+		db.saves[fp] = l
+	}
+	l.n++
+	db.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		db.Lock()
+		defer db.Unlock()
+		l.n--
+		if l.n == 0 {
+			delete(db.saves, fp)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gabriel-vasile/mimetype"
+)
+
+const propTime = "2006-01-02 15:04:05"
+
+// propsInfo writes a table with file attributes for the properties dialog
+func propsInfo(w io.Writer, fp string) {
+	if deniedPfx(fp) {
+		fmt.Fprintln(w, "&nbsp;<BR>forbidden<P>")
+		return
+	}
+	fi, err := os.Lstat(fp)
+	if err != nil {
+		fmt.Fprintf(w, "&nbsp;<BR>%v<P>\n", html.EscapeString(err.Error()))
+		return
+	}
+	row := func(k, v string) {
+		fmt.Fprintf(w, "<TR><TD NOWRAP VALIGN=\"TOP\">%v:&nbsp;</TD><TD>%v</TD></TR>\n", k, v)
+	}
+	fmt.Fprintln(w, `&nbsp;<BR><TABLE BORDER="0" CELLSPACING="0" CELLPADDING="1">`)
+	row("Name", "<B>"+html.EscapeString(fi.Name())+"</B>")
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		t, _ := os.Readlink(fp)
+		row("Type", "symbolic link to "+html.EscapeString(t))
+	case fi.IsDir():
+		row("Type", "directory")
+	case fi.Mode().IsRegular():
+		mt, err := mimetype.DetectFile(fp)
+		if err == nil {
+			row("Type", html.EscapeString(mt.String()))
+		}
+		row("Size", fmt.Sprintf("%v (%d bytes)", humanize.Bytes(uint64(fi.Size())), fi.Size()))
+	default:
+		row("Type", "special file")
+	}
+	row("Mode", fmt.Sprintf("%v (%04o)", fi.Mode().String(), unixMode(fi.Mode())))
+	row("Modified", fi.ModTime().Format(propTime)+" ("+humanize.Time(fi.ModTime())+")")
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok {
+		row("Owner", html.EscapeString(userName(st.Uid)))
+		row("Group", html.EscapeString(groupName(st.Gid)))
+		at, ct := statTimes(st)
+		row("Accessed", at.Format(propTime)+" ("+humanize.Time(at)+")")
+		row("Changed", ct.Format(propTime)+" ("+humanize.Time(ct)+")")
+		row("Inode", fmt.Sprint(st.Ino))
+		row("Links", fmt.Sprint(st.Nlink))
+	}
+	fmt.Fprintln(w, `</TABLE><P>`)
+}
+
+// propsForm writes fields for changing mode, owner, group and mtime, fi is nil for multiple files
+func propsForm(w io.Writer, fi os.FileInfo) {
+	fm, dm := "", ""
+	if fi != nil && fi.IsDir() {
+		dm = fmt.Sprintf("%04o", unixMode(fi.Mode()))
+	} else if fi != nil {
+		fm = fmt.Sprintf("%04o", unixMode(fi.Mode()))
+	}
+	fmt.Fprintf(w, `Change, empty fields are left unchanged:<P>
+		<TABLE BORDER="0" CELLSPACING="0" CELLPADDING="1">
+		<TR><TD>File mode:</TD><TD><INPUT TYPE="TEXT" NAME="fmode" SIZE="6" VALUE="%v"></TD></TR>
+		<TR><TD>Directory mode:</TD><TD><INPUT TYPE="TEXT" NAME="dmode" SIZE="6" VALUE="%v"></TD></TR>
+		`, fm, dm)
+	if len(chownUsers) > 0 {
+		fmt.Fprintln(w, `<TR><TD>Owner:</TD><TD><SELECT NAME="owner"><OPTION VALUE="">unchanged</OPTION>`)
+		for _, u := range chownUsers {
+			fmt.Fprintf(w, "<OPTION VALUE=\"%v\">%v</OPTION>\n", html.EscapeString(u), html.EscapeString(u))
+		}
+		fmt.Fprintln(w, `</SELECT></TD></TR>`)
+	}
+	if len(chownGroups) > 0 {
+		fmt.Fprintln(w, `<TR><TD>Group:</TD><TD><SELECT NAME="group"><OPTION VALUE="">unchanged</OPTION>`)
+		for _, g := range chownGroups {
+			fmt.Fprintf(w, "<OPTION VALUE=\"%v\">%v</OPTION>\n", html.EscapeString(g), html.EscapeString(g))
+		}
+		fmt.Fprintln(w, `</SELECT></TD></TR>`)
+	}
+	fmt.Fprintln(w, `<TR><TD>Modified:</TD><TD><INPUT TYPE="TEXT" NAME="mtime" SIZE="20" VALUE="">
+		<INPUT TYPE="CHECKBOX" NAME="touch" VALUE="1"> now</TD></TR>
+		<TR><TD>&nbsp;</TD><TD><FONT SIZE="-1">`+propTime+`</FONT></TD></TR>
+		</TABLE><P>
+		<INPUT TYPE="CHECKBOX" NAME="recursive" VALUE="1"> Apply to directory contents recursively<P>`)
+}
+
+func setProps(w http.ResponseWriter, r *http.Request, uDir string, uFiles []string, eSort, user string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	if len(uFiles) == 0 {
+		htErr(w, "properties", fmt.Errorf("no files selected"))
+		return
+	}
+	var fm, dm os.FileMode
+	var err error
+	cFm, cDm := r.FormValue("fmode") != "", r.FormValue("dmode") != ""
+	if cFm {
+		fm, err = parseMode(r.FormValue("fmode"))
+		if err != nil {
+			htErr(w, "properties", err)
+			return
+		}
+	}
+	if cDm {
+		dm, err = parseMode(r.FormValue("dmode"))
+		if err != nil {
+			htErr(w, "properties", err)
+			return
+		}
+	}
+	uid, gid := -1, -1
+	if o := r.FormValue("owner"); o != "" {
+		uid, err = chownId(o, chownUsers, lookupUid)
+		if err != nil {
+			htErr(w, "properties", err)
+			return
+		}
+	}
+	if g := r.FormValue("group"); g != "" {
+		gid, err = chownId(g, chownGroups, lookupGid)
+		if err != nil {
+			htErr(w, "properties", err)
+			return
+		}
+	}
+	var mt time.Time
+	switch {
+	case r.FormValue("touch") != "":
+		mt = time.Now()
+	case r.FormValue("mtime") != "":
+		mt, err = time.ParseInLocation(propTime, strings.TrimSpace(r.FormValue("mtime")), time.Local)
+		if err != nil {
+			htErr(w, "properties", fmt.Errorf("invalid time, use format %v", propTime))
+			return
+		}
+	}
+	rec := r.FormValue("recursive") != ""
+
+	set := func(p string, fi os.FileInfo) error {
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if uid != -1 || gid != -1 {
+				return os.Lchown(p, uid, gid)
+			}
+			return nil
+		}
+		if uid != -1 || gid != -1 {
+			err := os.Lchown(p, uid, gid)
+			if err != nil {
+				return err
+			}
+		}
+		if fi.IsDir() && cDm {
+			err := os.Chmod(p, dm)
+			if err != nil {
+				return err
+			}
+		}
+		if fi.Mode().IsRegular() && cFm {
+			err := os.Chmod(p, fm)
+			if err != nil {
+				return err
+			}
+		}
+		if !mt.IsZero() {
+			at := time.Now()
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				at, _ = statTimes(st)
+			}
+			return os.Chtimes(p, at, mt)
+		}
+		return nil
+	}
+
+	lF := ""
+	for _, f := range uFiles {
+		if deniedPfx(uDir + "/" + filepath.Base(f)) {
+			htErr(w, "access", fmt.Errorf("forbidden"))
+			return
+		}
+		lF = filepath.Base(f)
+	}
+	j := jobs.start(user, fmt.Sprintf("change properties of %v in %v", strings.Join(uFiles, ", "), uDir), func(ctx context.Context, j *job) error {
+		for _, f := range uFiles {
+			fp := filepath.Clean(uDir + "/" + filepath.Base(f))
+			fi, err := os.Lstat(fp)
+			if err != nil {
+				return err
+			}
+			if !rec || !fi.IsDir() {
+				err = set(fp, fi)
+				if err != nil {
+					return err
+				}
+				j.progress(0, 1)
+				continue
+			}
+			err = filepath.Walk(fp, func(p string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if deniedPfx(p) {
+					if fi.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				j.progress(0, 1)
+				return set(p, fi)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	jobRedirect(w, j, *wfmPfx+"?dir="+url.QueryEscape(uDir)+"&sort="+eSort+"&hi="+url.QueryEscape(lF), uDir, eSort)
+}
+
+// parseMode converts octal unix mode such as 0755 or 2775 to os.FileMode
+func parseMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil || n > 07777 {
+		return 0, fmt.Errorf("invalid mode %q, use octal eg. 0644", s)
+	}
+	m := os.FileMode(n & 0777)
+	if n&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if n&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if n&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m, nil
+}
+
+func unixMode(m os.FileMode) uint32 {
+	n := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		n |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		n |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		n |= 01000
+	}
+	return n
+}
+
+// chownId returns numeric id of name if it's on the allowed list
+func chownId(name string, allowed []string, lookup func(string) (string, error)) (int, error) {
+	for _, a := range allowed {
+		if a != name {
+			continue
+		}
+		id, err := lookup(name)
+		if err != nil {
+			return -1, err
+		}
+		return strconv.Atoi(id)
+	}
+	return -1, fmt.Errorf("%v is not allowed", name)
+}
+
+func lookupUid(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGid(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+func userName(uid uint32) string {
+	u, err := user.LookupId(fmt.Sprint(uid))
+	if err != nil {
+		return fmt.Sprint(uid)
+	}
+	return fmt.Sprintf("%v (%d)", u.Username, uid)
+}
+
+func groupName(gid uint32) string {
+	g, err := user.LookupGroupId(fmt.Sprint(gid))
+	if err != nil {
+		return fmt.Sprint(gid)
+	}
+	return fmt.Sprintf("%v (%d)", g.Name, gid)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const searchDate = "2006-01-02"
+
+// search is a parsed search form, zero values match everything
+type search struct {
+	glob    string
+	re      *regexp.Regexp
+	minSize uint64
+	maxSize uint64
+	after   time.Time
+	before  time.Time
+	kind    string
+}
+
+func parseSearch(r *http.Request) (*search, error) {
+	s := &search{kind: r.FormValue("type")}
+	var err error
+	q := r.FormValue("q")
+	switch {
+	case q == "":
+	case r.FormValue("re") != "":
+		s.re, err = regexp.Compile("(?i)" + q)
+		if err != nil {
+			return nil, err
+		}
+	case strings.ContainsAny(q, "*?["):
+		s.glob = strings.ToLower(q)
+		_, err = filepath.Match(s.glob, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", q)
+		}
+	default:
+		s.glob = "*" + strings.ToLower(q) + "*"
+	}
+	if v := r.FormValue("min"); v != "" {
+		s.minSize, err = humanize.ParseBytes(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v := r.FormValue("max"); v != "" {
+		s.maxSize, err = humanize.ParseBytes(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v := r.FormValue("after"); v != "" {
+		s.after, err = time.ParseInLocation(searchDate, v, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q, use %v", v, searchDate)
+		}
+	}
+	if v := r.FormValue("before"); v != "" {
+		s.before, err = time.ParseInLocation(searchDate, v, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q, use %v", v, searchDate)
+		}
+		// include the whole day
+		s.before = s.before.AddDate(0, 0, 1)
+	}
+	return s, nil
+}
+
+func (s *search) match(fi os.FileInfo) bool {
+	switch s.kind {
+	case "file":
+		if !fi.Mode().IsRegular() {
+			return false
+		}
+	case "dir":
+		if !fi.IsDir() {
+			return false
+		}
+	case "link":
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+	}
+	if s.glob != "" {
+		m, _ := filepath.Match(s.glob, strings.ToLower(fi.Name()))
+		if !m {
+			return false
+		}
+	}
+	if s.re != nil && !s.re.MatchString(fi.Name()) {
+		return false
+	}
+	if !fi.IsDir() && ((s.minSize > 0 && uint64(fi.Size()) < s.minSize) || (s.maxSize > 0 && uint64(fi.Size()) > s.maxSize)) {
+		return false
+	}
+	if !s.after.IsZero() && fi.ModTime().Before(s.after) {
+		return false
+	}
+	if !s.before.IsZero() && !fi.ModTime().Before(s.before) {
+		return false
+	}
+	return true
+}
+
+// searchFiles walks the tree from uDir and streams matching entries in a listing
+// table, the walk stops after search_max results or search_timeout
+func searchFiles(w http.ResponseWriter, r *http.Request, uDir, sort string, modern bool) {
+	if deniedPfx(uDir) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	s, err := parseSearch(r)
+	if err != nil {
+		htErr(w, "search", err)
+		return
+	}
+	i := icons(modern)
+	header(w, uDir, sort)
+	searchForm(w, r, uDir)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0" CLASS="thov">
+    <TR BGCOLOR="#A0A0A0">
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Name</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Size</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Modified</FONT></TD>
+    <TD NOWRAP>&nbsp;</TD>
+    </TR>
+    `))
+	fl, _ := w.(http.Flusher)
+
+	ctx, cancel := context.WithTimeout(r.Context(), *searchTime)
+	defer cancel()
+	n := 0
+	root := filepath.Clean(uDir)
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || p == root {
+			return nil
+		}
+		if deniedPfx(p) || (!*showDot && strings.HasPrefix(fi.Name(), ".")) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !s.match(fi) {
+			return nil
+		}
+		if n >= *searchMax {
+			return fmt.Errorf("stopped after %v results", *searchMax)
+		}
+		dir := filepath.Dir(p)
+		rel, _ := filepath.Rel(root, p)
+		li, ldir, broken := linkInfo(dir, fi, i, sort)
+		switch {
+		case broken:
+			brokenRow(w, dir, rel, fi, li, rowColor(n, false), sort, i, modern, false, false)
+		case fi.IsDir() || ldir:
+			dirRow(w, dir, rel, fi, li, rowColor(n, false), sort, i, false, false)
+		default:
+			fileRow(w, dir, rel, fi, li, rowColor(n, false), sort, i, modern, false, false)
+		}
+		n++
+		if fl != nil && n%50 == 0 {
+			fl.Flush()
+		}
+		return nil
+	})
+	st := fmt.Sprintf("%v found", n)
+	switch {
+	case err == context.DeadlineExceeded:
+		st += fmt.Sprintf(", search stopped after %v", *searchTime)
+	case err != nil:
+		st += ", " + html.EscapeString(err.Error())
+	}
+	w.Write([]byte(`<TR><TD COLSPAN="4" STYLE="border-top:1px solid grey">` + st + `</TD></TR></TABLE>`))
+	footer(w)
+}
+
+// searchForm writes search criteria fields prefilled from the last search
+func searchForm(w http.ResponseWriter, r *http.Request, uDir string) {
+	v := func(n string) string {
+		return html.EscapeString(r.FormValue(n))
+	}
+	ck := func(n, val string) string {
+		if r.FormValue(n) == val {
+			return " CHECKED"
+		}
+		return ""
+	}
+	sl := func(val string) string {
+		if r.FormValue("type") == val {
+			return " SELECTED"
+		}
+		return ""
+	}
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#EEEEEE" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD COLSPAN="2" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Search in ` + html.EscapeString(uDir) + `</FONT></TD></TR>
+    <TR><TD NOWRAP>
+    &nbsp;Name: <INPUT TYPE="TEXT" NAME="q" SIZE="20" VALUE="` + v("q") + `">
+    <INPUT TYPE="CHECKBOX" NAME="re" VALUE="1"` + ck("re", "1") + `> regexp &nbsp;
+    Type: <SELECT NAME="type">
+    <OPTION VALUE="">any</OPTION>
+    <OPTION VALUE="file"` + sl("file") + `>file</OPTION>
+    <OPTION VALUE="dir"` + sl("dir") + `>directory</OPTION>
+    <OPTION VALUE="link"` + sl("link") + `>symlink</OPTION>
+    </SELECT> &nbsp;
+    Size: <INPUT TYPE="TEXT" NAME="min" SIZE="6" VALUE="` + v("min") + `"> -
+    <INPUT TYPE="TEXT" NAME="max" SIZE="6" VALUE="` + v("max") + `"> &nbsp;
+    Modified: <INPUT TYPE="TEXT" NAME="after" SIZE="10" VALUE="` + v("after") + `"> -
+    <INPUT TYPE="TEXT" NAME="before" SIZE="10" VALUE="` + v("before") + `">
+    <FONT SIZE="-1">(` + searchDate + `)</FONT>
+    </TD><TD NOWRAP ALIGN="RIGHT">
+    <INPUT TYPE="SUBMIT" NAME="search" VALUE="Search" CLASS="nb">
+    ` + ftButton() + `
+    <INPUT TYPE="SUBMIT" NAME="cancel" VALUE="Back" CLASS="nb">&nbsp;
+    </TD></TR></TABLE>
+    `))
+}
+
+func ftButton() string {
+	if !*idxOn {
+		return ""
+	}
+	return `<INPUT TYPE="SUBMIT" NAME="ftsearch" VALUE="Search contents" CLASS="nb">`
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	shares    = newShareDB()
+	shareSalt = make([]byte, 32)
+)
+
+type share struct {
+	ID      string
+	Type    string // "dropbox" for upload only links
+	User    string
+	Path    string
+	Created time.Time
+	Expires time.Time
+	MaxDown int
+	Downs   int
+	Quota   uint64
+	Used    uint64
+	held    uint64 // quota reserved by uploads in progress
+	Salt    string
+	Hash    string
+}
+
+type shareDB struct {
+	entr map[string]*share
+	sync.Mutex
+}
+
+func newShareDB() *shareDB {
+	db := new(shareDB)
+	db.entr = make(map[string]*share)
+	rand.Read(shareSalt)
+	return db
+}
+
+func (s *share) active() bool {
+	if !s.Expires.IsZero() && time.Now().After(s.Expires) {
+		return false
+	}
+	if s.MaxDown > 0 && s.Downs >= s.MaxDown {
+		return false
+	}
+	return true
+}
+
+func (db *shareDB) load() {
+	db.Lock()
+	defer db.Unlock()
+	j, err := ioutil.ReadFile(*shareDb)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("unable to read share db: %v", err)
+		return
+	}
+	l := []*share{}
+	err = json.Unmarshal(j, &l)
+	if err != nil {
+		log.Printf("unable to parse share db: %v", err)
+		return
+	}
+	for _, s := range l {
+		db.entr[s.ID] = s
+	}
+	log.Printf("Loaded %q (%d shares)", *shareDb, len(db.entr))
+}
+
+// save writes active shares to disk, must be called with lock held
+func (db *shareDB) save() error {
+	l := []*share{}
+	for id, s := range db.entr {
+		if !s.active() {
+			delete(db.entr, id)
+			continue
+		}
+		l = append(l, s)
+	}
+	j, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*shareDb+".tmp", j, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(*shareDb+".tmp", *shareDb)
+}
+
+func (db *shareDB) add(s *share) error {
+	db.Lock()
+	defer db.Unlock()
+	db.entr[s.ID] = s
+	err := db.save()
+	if err != nil {
+		delete(db.entr, s.ID)
+	}
+	return err
+}
+
+func (db *shareDB) get(id string) (share, bool) {
+	db.Lock()
+	defer db.Unlock()
+	s, ok := db.entr[id]
+	if !ok || !s.active() {
+		return share{}, false
+	}
+	return *s, true
+}
+
+// count records a download, returns false if the link is no longer valid
+func (db *shareDB) count(id string) bool {
+	db.Lock()
+	defer db.Unlock()
+	s, ok := db.entr[id]
+	if !ok || !s.active() {
+		return false
+	}
+	s.Downs++
+	if s.MaxDown > 0 {
+		err := db.save()
+		if err != nil {
+			log.Printf("share: unable to save db: %v", err)
+		}
+	}
+	return true
+}
+
+// left returns drop box quota neither used nor reserved by uploads in progress
+func (s *share) left() uint64 {
+	if s.Used+s.held >= s.Quota {
+		return 0
+	}
+	return s.Quota - s.Used - s.held
+}
+
+// reserve sets aside drop box quota for an upload of size bytes, or all of it
+// for unknown size, returns the reserved amount or false if size doesn't fit
+func (db *shareDB) reserve(id string, size int64) (uint64, bool) {
+	db.Lock()
+	defer db.Unlock()
+	s, ok := db.entr[id]
+	if !ok {
+		return 0, false
+	}
+	l := s.left()
+	if l == 0 || (size > 0 && uint64(size) > l) {
+		return l, false
+	}
+	if size > 0 {
+		l = uint64(size)
+	}
+	s.held += l
+	return l, true
+}
+
+// use releases reserved quota and records n bytes uploaded to a drop box
+func (db *shareDB) use(id string, res, n uint64) {
+	db.Lock()
+	defer db.Unlock()
+	s, ok := db.entr[id]
+	if !ok {
+		return
+	}
+	s.held -= res
+	s.Used += n
+	err := db.save()
+	if err != nil {
+		log.Printf("share: unable to save db: %v", err)
+	}
+}
+
+func (db *shareDB) revoke(id, user string) error {
+	db.Lock()
+	defer db.Unlock()
+	s, ok := db.entr[id]
+	if !ok || s.User != user {
+		return fmt.Errorf("share not found")
+	}
+	delete(db.entr, id)
+	return db.save()
+}
+
+func (db *shareDB) list(user string) []share {
+	db.Lock()
+	defer db.Unlock()
+	l := []share{}
+	for _, s := range db.entr {
+		if s.User != user || !s.active() {
+			continue
+		}
+		l = append(l, *s)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Created.Before(l[j].Created)
+	})
+	return l
+}
+
+func mkShare(w http.ResponseWriter, r *http.Request, uDir, uBn, eSort, user string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	fp := filepath.Clean(uDir + "/" + uBn)
+	if deniedPfx(fp) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	if *sharePfx == "" {
+		htErr(w, "share", fmt.Errorf("sharing is disabled"))
+		return
+	}
+	fi, err := os.Stat(fp)
+	if err != nil {
+		htErr(w, "share", err)
+		return
+	}
+	b := make([]byte, 18)
+	rand.Read(b)
+	s := &share{
+		ID:      base64.RawURLEncoding.EncodeToString(b),
+		User:    user,
+		Path:    fp,
+		Created: time.Now(),
+	}
+	if e := r.FormValue("expire"); e != "" && e != "0" {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			htErr(w, "share", err)
+			return
+		}
+		s.Expires = s.Created.Add(d)
+	}
+	if m := r.FormValue("maxdown"); m != "" {
+		s.MaxDown, err = strconv.Atoi(m)
+		if err != nil || s.MaxDown < 0 {
+			htErr(w, "share", fmt.Errorf("invalid download limit"))
+			return
+		}
+	}
+	if r.FormValue("type") == "dropbox" {
+		if !fi.IsDir() {
+			htErr(w, "share", fmt.Errorf("drop box must be a directory"))
+			return
+		}
+		s.Type = "dropbox"
+		s.MaxDown = 0
+		s.Quota, err = humanize.ParseBytes(r.FormValue("quota"))
+		if err != nil || s.Quota == 0 {
+			htErr(w, "share", fmt.Errorf("invalid drop box quota"))
+			return
+		}
+	}
+	if p := r.FormValue("password"); p != "" {
+		s.Salt = rndStr(8)
+		s.Hash = fmt.Sprintf("%x", sha256.Sum256([]byte(s.Salt+p)))
+	}
+	err = shares.add(s)
+	if err != nil {
+		htErr(w, "share", err)
+		return
+	}
+	log.Printf("share: created id=%v type=%q path=%v expires=%v maxdown=%v quota=%v user=%v@%v", s.ID, s.Type, fp, s.Expires, s.MaxDown, s.Quota, user, r.RemoteAddr)
+	listShares(w, r, uDir, eSort, user, s.ID)
+}
+
+func rmShare(w http.ResponseWriter, r *http.Request, uDir, eSort, user string) {
+	err := shares.revoke(r.FormValue("id"), user)
+	if err != nil {
+		htErr(w, "unshare", err)
+		return
+	}
+	log.Printf("share: revoked id=%v user=%v@%v", r.FormValue("id"), user, r.RemoteAddr)
+	redirect(w, *wfmPfx+"?fn=shares&dir="+url.QueryEscape(uDir)+"&sort="+eSort)
+}
+
+func shareUrl(r *http.Request, id string) string {
+	p := "http://"
+	if r.TLS != nil {
+		p = "https://"
+	}
+	return p + r.Host + strings.TrimSuffix(*sharePfx, "/") + "/" + id
+}
+
+func listShares(w http.ResponseWriter, r *http.Request, uDir, eSort, user, hi string) {
+	header(w, uDir, eSort)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD COLSPAN="6" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Active shares of ` + html.EscapeString(user) + `</FONT></TD></TR>
+    <TR BGCOLOR="#A0A0A0">
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Path</FONT></TD>
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Link</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Expires</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Downloads / Uploads</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Password</FONT></TD>
+    <TD NOWRAP ALIGN="right">&nbsp;</TD>
+    </TR>
+    `))
+	for n, s := range shares.list(user) {
+		bg := "#FFFFFF"
+		if s.ID == hi {
+			bg = "#33CC33"
+		} else if n%2 == 1 {
+			bg = "#F0F0F0"
+		}
+		ex := "never"
+		if !s.Expires.IsZero() {
+			ex = "(" + humanize.Time(s.Expires) + ") " + s.Expires.Format(time.Stamp)
+		}
+		md := fmt.Sprint(s.Downs) + " / unlimited"
+		if s.MaxDown > 0 {
+			md = fmt.Sprint(s.Downs) + " / " + fmt.Sprint(s.MaxDown)
+		}
+		if s.Type == "dropbox" {
+			md = "drop box " + humanize.Bytes(s.Used) + " / " + humanize.Bytes(s.Quota)
+		}
+		pw := "no"
+		if s.Hash != "" {
+			pw = "yes"
+		}
+		u := html.EscapeString(shareUrl(r, s.ID))
+		fmt.Fprintf(w, `<TR BGCOLOR="%v"><TD NOWRAP>%v</TD><TD NOWRAP><A HREF="%v">%v</A></TD>`+
+			`<TD NOWRAP ALIGN="right">%v</TD><TD NOWRAP ALIGN="right">%v</TD><TD NOWRAP ALIGN="right">%v</TD>`+
+			`<TD NOWRAP ALIGN="right"><A HREF="%v?fn=unshare&amp;id=%v&amp;dir=%v&amp;sort=%v">revoke</A>&nbsp;</TD></TR>`+"\n",
+			bg, html.EscapeString(s.Path), u, u, ex, md, pw,
+			*wfmPfx, url.QueryEscape(s.ID), url.QueryEscape(uDir), html.EscapeString(eSort))
+	}
+	w.Write([]byte(`
+    </TABLE><P>
+    &nbsp;<INPUT TYPE="SUBMIT" VALUE=" OK " NAME="OK">
+    `))
+	footer(w)
+}
+
+// shareHandler serves anonymous requests for shared links, without auth()
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	p := strings.SplitN(strings.TrimPrefix(r.URL.Path, *sharePfx), "/", 2)
+	s, ok := shares.get(p[0])
+	if !ok {
+		http.Error(w, "This link does not exist or has expired", http.StatusNotFound)
+		return
+	}
+	if s.Hash != "" && !shareAuth(w, r, &s) {
+		return
+	}
+	if s.Type == "dropbox" {
+		shareDropbox(w, r, &s)
+		return
+	}
+	rel := ""
+	if len(p) > 1 {
+		rel = strings.TrimPrefix(filepath.Clean("/"+p[1]), "/")
+	}
+	fi, err := os.Stat(s.Path)
+	if err != nil || deniedPfx(s.Path) {
+		http.Error(w, "Shared file is no longer available", http.StatusGone)
+		return
+	}
+	fp := s.Path
+	sp := ""
+	if fi.IsDir() {
+		fp = filepath.Clean(s.Path + "/" + rel)
+		if deniedPfx(fp) || (!*showDot && strings.Contains("/"+rel, "/.")) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		rp, err := filepath.EvalSymlinks(fp)
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if deniedPfx(rp) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		// symlinks inside of the shared folder must not lead out of it
+		sp, err = filepath.EvalSymlinks(s.Path)
+		if err != nil || (rp != sp && !strings.HasPrefix(rp, sp+"/")) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		fi, err = os.Stat(fp)
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+	} else if rel != "" && rel != fi.Name() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	go log.Printf("share: req from=%q id=%v path=%v uri=%q", r.RemoteAddr, s.ID, fp, r.RequestURI)
+
+	switch {
+	case fi.IsDir() && r.FormValue("format") != "":
+		if !shares.count(s.ID) {
+			http.Error(w, "Download limit reached", http.StatusGone)
+			return
+		}
+		downArchive(w, filepath.Dir(fp), []string{filepath.Base(fp)}, r.FormValue("format"), sp)
+	case fi.IsDir():
+		shareDir(w, &s, rel, fp, sp)
+	case rel == "":
+		shareLanding(w, &s, fi)
+	default:
+		if rangeToEnd(r, fi.Size()) && !shares.count(s.ID) {
+			http.Error(w, "Download limit reached", http.StatusGone)
+			return
+		}
+		f, err := os.Open(fp)
+		if err != nil {
+			http.Error(w, "Unable to open file", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+fi.Name()+"\";")
+		serveFile(w, r, f)
+	}
+}
+
+// rangeToEnd reports whether the response to r delivers the last byte of a file
+// of size, every complete download ends with such response no matter how it was
+// split in to ranges, so these are counted as downloads
+func rangeToEnd(r *http.Request, size int64) bool {
+	rg := r.Header.Get("Range")
+	if rg == "" || r.Header.Get("If-Range") != "" || !strings.HasPrefix(rg, "bytes=") {
+		return true
+	}
+	for _, p := range strings.Split(strings.TrimPrefix(rg, "bytes="), ",") {
+		se := strings.SplitN(strings.TrimSpace(p), "-", 2)
+		if len(se) != 2 || se[0] == "" || se[1] == "" {
+			return true
+		}
+		e, err := strconv.ParseInt(se[1], 10, 64)
+		if err != nil || e >= size-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// shareAuth checks password cookie or form, asks for a password if missing
+func shareAuth(w http.ResponseWriter, r *http.Request, s *share) bool {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if f2b.check(ip) {
+		http.Error(w, "Too many bad password attempts", http.StatusTooManyRequests)
+		return false
+	}
+	m := hmac.New(sha256.New, shareSalt)
+	m.Write([]byte(s.ID + s.Hash))
+	ck := hex.EncodeToString(m.Sum(nil))
+	c, err := r.Cookie("wfmshare")
+	if err == nil && subtle.ConstantTimeCompare([]byte(c.Value), []byte(ck)) == 1 {
+		return true
+	}
+	bad := false
+	// don't let PostFormValue spool multipart uploads to disk
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if p := r.PostFormValue("password"); p != "" {
+		h := fmt.Sprintf("%x", sha256.Sum256([]byte(s.Salt+p)))
+		if subtle.ConstantTimeCompare([]byte(h), []byte(s.Hash)) == 1 {
+			go f2b.unban(ip)
+			http.SetCookie(w, &http.Cookie{
+				Name:     "wfmshare",
+				Value:    ck,
+				Path:     strings.TrimSuffix(*sharePfx, "/") + "/" + s.ID,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+				Secure:   r.TLS != nil,
+			})
+			redirect(w, r.URL.Path)
+			return false
+		}
+		log.Printf("share: bad password id=%v ip=%v", s.ID, ip)
+		f2b.ban(ip)
+		bad = true
+	}
+	htHead(w, "Password required")
+	w.Write([]byte(`
+    <FORM ACTION="` + html.EscapeString(r.URL.Path) + `" METHOD="POST">
+    <TABLE WIDTH="100%" HEIGHT="90%" BORDER="0" CELLSPACING="0" CELLPADDING="0"><TR><TD VALIGN="MIDDLE" ALIGN="CENTER">
+    <TABLE WIDTH="400" BGCOLOR="#F0F0F0" BORDER="0" CELLSPACING="0" CELLPADDING="1" CLASS="tbr">
+      <TR><TD COLSPAN="2" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Password required</FONT></TD></TR>
+      <TR><TD WIDTH="30">&nbsp;</TD><TD>
+    `))
+	if bad {
+		w.Write([]byte(`&nbsp;<BR><FONT COLOR="#CC0000">Wrong password</FONT>`))
+	}
+	w.Write([]byte(`
+      &nbsp;<BR>This link is password protected:<P>
+      <INPUT TYPE="PASSWORD" NAME="password" SIZE="40" VALUE="">
+      </TD></TR>
+    <TR><TD COLSPAN="2"><P><CENTER><INPUT TYPE="SUBMIT" VALUE=" OK "></CENTER></TD></TR>
+    <TR><TD COLSPAN="2">&nbsp;</TD></TR>
+    </TABLE>
+    </TD></TR></TABLE>
+    `))
+	footer(w)
+	return false
+}
+
+func shareLanding(w http.ResponseWriter, s *share, fi os.FileInfo) {
+	eName := html.EscapeString(fi.Name())
+	htHead(w, eName)
+	w.Write([]byte(`
+    <FORM ACTION="" METHOD="GET">
+    <TABLE WIDTH="100%" HEIGHT="90%" BORDER="0" CELLSPACING="0" CELLPADDING="0"><TR><TD VALIGN="MIDDLE" ALIGN="CENTER">
+    <TABLE WIDTH="400" BGCOLOR="#F0F0F0" BORDER="0" CELLSPACING="0" CELLPADDING="1" CLASS="tbr">
+      <TR><TD COLSPAN="2" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Shared file</FONT></TD></TR>
+      <TR><TD WIDTH="30">&nbsp;</TD><TD>
+      &nbsp;<BR><B>` + eName + `</B><BR>
+      Size: ` + humanize.Bytes(uint64(fi.Size())) + `<BR>
+      Modified: ` + fi.ModTime().Format(time.Stamp) + `<P>
+      <A HREF="` + html.EscapeString(strings.TrimSuffix(*sharePfx, "/")+"/"+s.ID+"/"+url.PathEscape(fi.Name())) + `">Download</A><P>
+      </TD></TR>
+    <TR><TD COLSPAN="2">&nbsp;</TD></TR>
+    </TABLE>
+    </TD></TR></TABLE>
+    `))
+	footer(w)
+}
+
+func shareDir(w http.ResponseWriter, s *share, rel, fp, root string) {
+	d, err := ioutil.ReadDir(fp)
+	if err != nil {
+		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
+		return
+	}
+	base := strings.TrimSuffix(*sharePfx, "/") + "/" + s.ID
+	for _, n := range strings.Split(rel, "/") {
+		if n != "" {
+			base += "/" + url.PathEscape(n)
+		}
+	}
+	eTitle := html.EscapeString(filepath.Base(s.Path) + "/" + rel)
+	htHead(w, eTitle)
+	w.Write([]byte(`
+    <FORM ACTION="` + html.EscapeString(base) + `" METHOD="GET">
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0" CLASS="thov">
+    <TR><TD COLSPAN="2" BGCOLOR="#0072c6"><FONT COLOR="#FFFFFF">&nbsp;` + eTitle + `</FONT></TD>
+    <TD NOWRAP ALIGN="right" BGCOLOR="#F1F1F1">` + arcFormats() + ` <INPUT TYPE="SUBMIT" VALUE="Download all">&nbsp;</TD></TR>
+    `))
+	if rel != "" {
+		w.Write([]byte(`<TR><TD COLSPAN="3"><A HREF="` + html.EscapeString(base) + `/..">&#187; ..</A></TD></TR>`))
+	}
+	sort.Slice(d, func(i, j int) bool {
+		if d[i].IsDir() != d[j].IsDir() {
+			return d[i].IsDir()
+		}
+		return d[i].Name() < d[j].Name()
+	})
+	for _, f := range d {
+		if deniedPfx(fp+"/"+f.Name()) || (!*showDot && strings.HasPrefix(f.Name(), ".")) {
+			continue
+		}
+		fi, err := os.Stat(fp + "/" + f.Name())
+		if err != nil {
+			continue
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			// don't list what the share wouldn't serve
+			t, err := filepath.EvalSymlinks(fp + "/" + f.Name())
+			if err != nil || (t != root && !strings.HasPrefix(t, root+"/")) {
+				continue
+			}
+		}
+		href := html.EscapeString(base + "/" + url.PathEscape(f.Name()))
+		eName := html.EscapeString(f.Name())
+		sz := humanize.Bytes(uint64(fi.Size()))
+		if fi.IsDir() {
+			eName += "/"
+			sz = "&nbsp;"
+		}
+		w.Write([]byte(`<TR><TD NOWRAP><A HREF="` + href + `">` + eName + `</A></TD>` +
+			`<TD NOWRAP ALIGN="right">` + sz + `</TD>` +
+			`<TD NOWRAP ALIGN="right">` + fi.ModTime().Format(time.Stamp) + `&nbsp;</TD></TR>` + "\n"))
+	}
+	w.Write([]byte(`</TABLE>`))
+	footer(w)
+}
+
+// shareDropbox shows anonymous visitors an upload form only, never a listing
+func shareDropbox(w http.ResponseWriter, r *http.Request, s *share) {
+	fi, err := os.Stat(s.Path)
+	if err != nil || !fi.IsDir() || deniedPfx(s.Path) {
+		http.Error(w, "Drop box is no longer available", http.StatusGone)
+		return
+	}
+	var up []upFile
+	msg := ""
+	if r.Method == http.MethodPost {
+		free, ok := shares.reserve(s.ID, r.ContentLength)
+		if !ok {
+			msg = "Upload exceeds drop box quota, " + humanize.Bytes(free) + " left"
+		} else {
+			up, err = readForm(r, true, s.Path, int64(free))
+			defer cleanUploads(up)
+			if err != nil {
+				msg = "Upload failed: " + err.Error()
+			}
+			// visitors see the names they sent, not what they were stored as
+			sent := make([]string, len(up))
+			for i, u := range up {
+				sent[i] = u.name
+			}
+			placeUploads(s.Path, up, "rename")
+			for i := range up {
+				up[i].name = sent[i]
+			}
+			var n uint64
+			for _, u := range up {
+				if u.err == nil {
+					n += uint64(u.size)
+				}
+			}
+			shares.use(s.ID, free, n)
+			s.Used += n
+			log.Printf("share: drop box id=%v from=%v files=%v size=%v", s.ID, r.RemoteAddr, len(up), n)
+		}
+	}
+
+	pfx := strings.TrimSuffix(*sharePfx, "/") + "/" + s.ID
+	htHead(w, "Upload")
+	w.Write([]byte(`
+    <FORM ACTION="` + html.EscapeString(pfx) + `" METHOD="POST" ENCTYPE="multipart/form-data">
+    <TABLE WIDTH="100%" HEIGHT="90%" BORDER="0" CELLSPACING="0" CELLPADDING="0"><TR><TD VALIGN="MIDDLE" ALIGN="CENTER">
+    <TABLE WIDTH="500" BGCOLOR="#F0F0F0" BORDER="0" CELLSPACING="0" CELLPADDING="1" CLASS="tbr">
+      <TR><TD COLSPAN="2" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Upload files</FONT></TD></TR>
+      <TR><TD WIDTH="30">&nbsp;</TD><TD>&nbsp;<BR>
+    `))
+	if msg != "" {
+		w.Write([]byte(`<FONT COLOR="#CC0000">` + html.EscapeString(msg) + `</FONT><P>`))
+	}
+	if len(up) > 0 {
+		w.Write([]byte("<UL>\n"))
+		for _, u := range up {
+			res := "uploaded, " + humanize.Bytes(uint64(u.size))
+			if u.err != nil {
+				res = `<FONT COLOR="#CC0000">` + html.EscapeString(u.err.Error()) + `</FONT>`
+			}
+			w.Write([]byte(`<LI TYPE="square">` + html.EscapeString(u.name) + ` - ` + res + "</LI>\n"))
+		}
+		w.Write([]byte("</UL>\n"))
+	}
+	exp := ""
+	if !s.Expires.IsZero() {
+		exp = "<BR>This drop box expires " + humanize.Time(s.Expires) + "."
+	}
+	w.Write([]byte(`
+      Select files to send, up to ` + humanize.Bytes(s.left()) + ` in total.` + exp + `<P>
+      <INPUT TYPE="FILE" NAME="filename" MULTIPLE><P>
+      </TD></TR>
+    <TR><TD COLSPAN="2"><P><CENTER><INPUT TYPE="SUBMIT" VALUE=" Upload "></CENTER></TD></TR>
+    <TR><TD COLSPAN="2">&nbsp;</TD></TR>
+    </TABLE>
+    </TD></TR></TABLE>
+    `))
+	footer(w)
+}
@@ -0,0 +1,13 @@
+//go:build linux || openbsd || solaris || dragonfly
+// +build linux openbsd solaris dragonfly
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+func statTimes(st *syscall.Stat_t) (time.Time, time.Time) {
+	return time.Unix(st.Atim.Unix()), time.Unix(st.Ctim.Unix())
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package main
+
+import "syscall"
+
+func diskStat(uDir string) (fsStat, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(uDir, &st)
+	if err != nil {
+		return fsStat{}, err
+	}
+	bs := uint64(st.Bsize)
+	return fsStat{
+		total: uint64(st.Blocks) * bs,
+		free:  uint64(st.Bfree) * bs,
+		avail: uint64(st.Bavail) * bs,
+		files: uint64(st.Files),
+		ffree: uint64(st.Ffree),
+	}, nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+func diskStat(uDir string) (fsStat, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(uDir, &st)
+	if err != nil {
+		return fsStat{}, err
+	}
+	bs := uint64(st.F_bsize)
+	return fsStat{
+		total: uint64(st.F_blocks) * bs,
+		free:  uint64(st.F_bfree) * bs,
+		avail: uint64(st.F_bavail) * bs,
+		files: uint64(st.F_files),
+		ffree: uint64(st.F_ffree),
+	}, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd
+// +build !linux,!darwin,!freebsd,!dragonfly,!openbsd
+
+package main
+
+func diskStat(uDir string) (fsStat, error) {
+	return fsStat{}, errNoStatfs
+}
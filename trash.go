@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// trash follows freedesktop.org trash specification, deleted files are
+// kept in files/ and their original location and deletion time in info/,
+// files on other filesystems than trash_dir go to .Trash-$uid in the top
+// directory of their filesystem instead of being copied across, these are
+// recorded in trash_dir/mounts to be found again
+
+const trashTime = "2006-01-02T15:04:05"
+
+var trashMu sync.Mutex
+
+type trashItem struct {
+	Dir     string // trash directory holding the item
+	Name    string
+	Path    string
+	Deleted time.Time
+	fi      os.FileInfo
+}
+
+// trashDirs returns the main trash and trash directories on other filesystems
+func trashDirs() []string {
+	l := []string{*trashDir}
+	b, _ := ioutil.ReadFile(*trashDir + "/mounts")
+	for _, d := range strings.Split(string(b), "\n") {
+		if filepath.IsAbs(d) {
+			l = append(l, d)
+		}
+	}
+	return l
+}
+
+// mountTrash returns name of the per filesystem trash directory
+func mountTrash() string {
+	return ".Trash-" + strconv.Itoa(os.Getuid())
+}
+
+// trashFor returns trash directory on the same filesystem as fp
+func trashFor(fp string) (string, error) {
+	err := os.MkdirAll(*trashDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	t, err := os.Stat(*trashDir)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(fp)
+	if err != nil {
+		return "", err
+	}
+	dev := devNo(fi)
+	if dev == devNo(t) {
+		return *trashDir, nil
+	}
+	top := filepath.Dir(fp)
+	for top != "/" {
+		p, err := os.Stat(filepath.Dir(top))
+		if err != nil || devNo(p) != dev {
+			break
+		}
+		top = filepath.Dir(top)
+	}
+	d := strings.TrimSuffix(top, "/") + "/" + mountTrash()
+	trashMu.Lock()
+	defer trashMu.Unlock()
+	for _, e := range trashDirs() {
+		if e == d {
+			return d, nil
+		}
+	}
+	f, err := os.OpenFile(*trashDir+"/mounts", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintln(f, d)
+	return d, f.Close()
+}
+
+// trashFile moves fp to trash, the .trashinfo file is created first
+// exclusively to reserve a unique name as required by the spec
+func trashFile(ctx context.Context, j *job, fp string) error {
+	td, err := trashFor(fp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(td+"/files", 0700)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(td+"/info", 0700)
+	if err != nil {
+		return err
+	}
+	b := filepath.Base(fp)
+	n := b
+	var f *os.File
+	for i := 2; ; i++ {
+		f, err = os.OpenFile(td+"/info/"+n+".trashinfo", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if !os.IsExist(err) {
+			break
+		}
+		n = filepath.Base(numberedName(fp, i))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "[Trash Info]\nPath=%v\nDeletionDate=%v\n", (&url.URL{Path: fp}).EscapedPath(), time.Now().Format(trashTime))
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err = movePath(ctx, j, fp, td+"/files/"+n)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	log.Printf("trash: moved %v to trash %v as %v", fp, td, n)
+	return nil
+}
+
+// trashInfo returns item name of trash directory dir, which must be one of trashDirs
+func trashInfo(dir, name string) (trashItem, error) {
+	t := trashItem{Dir: dir, Name: name}
+	known := false
+	for _, d := range trashDirs() {
+		if d == dir {
+			known = true
+		}
+	}
+	if !known {
+		return t, fmt.Errorf("unknown trash directory")
+	}
+	b, err := ioutil.ReadFile(dir + "/info/" + name + ".trashinfo")
+	if err != nil {
+		return t, err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(l), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Path":
+			t.Path, err = url.PathUnescape(kv[1])
+			if err != nil {
+				return t, err
+			}
+		case "DeletionDate":
+			t.Deleted, _ = time.ParseInLocation(trashTime, kv[1], time.Local)
+		}
+	}
+	if !filepath.IsAbs(t.Path) {
+		return t, fmt.Errorf("invalid path in trash info for %v", name)
+	}
+	t.fi, err = os.Lstat(dir + "/files/" + name)
+	return t, err
+}
+
+// trashList returns items of all trash directories, leaving out those deleted
+// from denied paths unless all is set
+func trashList(all bool) []trashItem {
+	l := []trashItem{}
+	for _, td := range trashDirs() {
+		d, _ := ioutil.ReadDir(td + "/info")
+		for _, f := range d {
+			if !strings.HasSuffix(f.Name(), ".trashinfo") {
+				continue
+			}
+			t, err := trashInfo(td, strings.TrimSuffix(f.Name(), ".trashinfo"))
+			if err != nil || (!all && deniedPfx(t.Path)) {
+				continue
+			}
+			l = append(l, t)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Deleted.After(l[j].Deleted)
+	})
+	return l
+}
+
+func trashRemove(t trashItem) error {
+	err := os.RemoveAll(t.Dir + "/files/" + t.Name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(t.Dir + "/info/" + t.Name + ".trashinfo")
+}
+
+func restoreTrash(w http.ResponseWriter, uDir, uTrash, uName, eSort, user string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if *hardDelete {
+		htErr(w, "restore", fmt.Errorf("trash is disabled"))
+		return
+	}
+	t, err := trashInfo(uTrash, filepath.Base(uName))
+	if err != nil {
+		htErr(w, "restore", err)
+		return
+	}
+	if deniedPfx(t.Path) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	_, err = os.Lstat(t.Path)
+	if err == nil {
+		htErr(w, "restore", fmt.Errorf("%v already exists", t.Path))
+		return
+	}
+	j := jobs.start(user, fmt.Sprintf("restore %v from trash", t.Path), func(ctx context.Context, j *job) error {
+		err := os.MkdirAll(filepath.Dir(t.Path), 0755)
+		if err != nil {
+			return err
+		}
+		err = movePath(ctx, j, t.Dir+"/files/"+t.Name, t.Path)
+		if err != nil {
+			return err
+		}
+		return os.Remove(t.Dir + "/info/" + t.Name + ".trashinfo")
+	})
+	jobRedirect(w, j, *wfmPfx+"?dir="+url.QueryEscape(filepath.Dir(t.Path))+"&sort="+eSort+"&hi="+url.QueryEscape(filepath.Base(t.Path)), uDir, eSort)
+}
+
+func purgeTrash(w http.ResponseWriter, uDir, uTrash, uName, eSort string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if *hardDelete {
+		htErr(w, "purge", fmt.Errorf("trash is disabled"))
+		return
+	}
+	l := trashList(false)
+	if uName != "" {
+		t, err := trashInfo(uTrash, filepath.Base(uName))
+		if err != nil {
+			htErr(w, "purge", err)
+			return
+		}
+		if deniedPfx(t.Path) {
+			htErr(w, "access", fmt.Errorf("forbidden"))
+			return
+		}
+		l = []trashItem{t}
+	}
+	for _, t := range l {
+		err := trashRemove(t)
+		if err != nil {
+			htErr(w, "purge", err)
+			return
+		}
+		log.Printf("trash: purged %v (%v)", t.Name, t.Path)
+	}
+	redirect(w, *wfmPfx+"?fn=trash&dir="+url.QueryEscape(uDir)+"&sort="+eSort)
+}
+
+func listTrash(w http.ResponseWriter, uDir, eSort string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if *hardDelete {
+		htErr(w, "trash", fmt.Errorf("trash is disabled"))
+		return
+	}
+	header(w, uDir, eSort)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD COLSPAN="5" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; Trash</FONT></TD></TR>
+    <TR BGCOLOR="#A0A0A0">
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Name</FONT></TD>
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Original location</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Size</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Deleted</FONT></TD>
+    <TD NOWRAP ALIGN="right">&nbsp;</TD>
+    </TR>
+    `))
+	l := trashList(false)
+	for n, t := range l {
+		bg := "#FFFFFF"
+		if n%2 == 1 {
+			bg = "#F0F0F0"
+		}
+		sz := "directory"
+		if !t.fi.IsDir() {
+			sz = humanize.Bytes(uint64(t.fi.Size()))
+		}
+		qN := url.QueryEscape(t.Name) + "&amp;trash=" + url.QueryEscape(t.Dir)
+		fmt.Fprintf(w, `<TR BGCOLOR="%v"><TD NOWRAP>%v</TD><TD NOWRAP>%v</TD><TD NOWRAP ALIGN="right">%v</TD>`+
+			`<TD NOWRAP ALIGN="right">(%v) %v</TD><TD NOWRAP ALIGN="right">`+
+			`<A HREF="%v?fn=restore&amp;file=%v&amp;dir=%v&amp;sort=%v">restore</A>&nbsp;`+
+			`<A HREF="%v?fn=purgep&amp;file=%v&amp;dir=%v&amp;sort=%v">purge</A>&nbsp;</TD></TR>`+"\n",
+			bg, html.EscapeString(filepath.Base(t.Path)), html.EscapeString(filepath.Dir(t.Path)), sz,
+			humanize.Time(t.Deleted), t.Deleted.Format(time.Stamp),
+			*wfmPfx, qN, url.QueryEscape(uDir), html.EscapeString(eSort),
+			*wfmPfx, qN, url.QueryEscape(uDir), html.EscapeString(eSort))
+	}
+	ex := "never"
+	if *trashExpire > 0 {
+		ex = "after " + strings.TrimSpace(humanize.RelTime(time.Now(), time.Now().Add(*trashExpire), "", ""))
+	}
+	w.Write([]byte(`
+    </TABLE><P>
+    &nbsp;Items are purged automatically ` + ex + `.<P>
+    &nbsp;<INPUT TYPE="SUBMIT" VALUE=" OK " NAME="OK">
+    `))
+	if len(l) > 0 {
+		w.Write([]byte(`<INPUT TYPE="SUBMIT" VALUE=" Empty Trash " NAME="emptyp">`))
+	}
+	footer(w)
+}
+
+// trashPurge removes items deleted longer than trash_expire ago
+func trashPurge() {
+	for {
+		if *trashExpire > 0 {
+			for _, t := range trashList(true) {
+				if time.Since(t.Deleted) < *trashExpire {
+					continue
+				}
+				log.Printf("trash: expiring %v (%v) deleted %v", t.Name, t.Path, t.Deleted)
+				err := trashRemove(t)
+				if err != nil {
+					log.Printf("trash: %v", err)
+				}
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tus 1.0 resumable upload protocol, see https://tus.io/protocols/resumable-upload
+
+const tusVersion = "1.0.0"
+
+var (
+	tusBusy = newTusLocks()
+)
+
+type tusInfo struct {
+	ID      string
+	User    string
+	Dir     string
+	Name    string
+	Size    int64
+	Meta    string
+	Expires time.Time
+}
+
+type tusLocks struct {
+	busy map[string]bool
+	sync.Mutex
+}
+
+func newTusLocks() *tusLocks {
+	l := new(tusLocks)
+	l.busy = make(map[string]bool)
+	return l
+}
+
+func (l *tusLocks) lock(id string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.busy[id] {
+		return false
+	}
+	l.busy[id] = true
+	return true
+}
+
+func (l *tusLocks) unlock(id string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.busy, id)
+}
+
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	user, rw := auth(w, r)
+	if user == "" {
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+
+	m := r.Method
+	if o := r.Header.Get("X-HTTP-Method-Override"); o != "" {
+		m = o
+	}
+	if m == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,creation-with-upload,termination,checksum,expiration")
+		w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+		if maxUpload > 0 {
+			w.Header().Set("Tus-Max-Size", fmt.Sprint(uint64(maxUpload)))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	if !rw {
+		http.Error(w, "read only", http.StatusForbidden)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, *tusPfx), "/")
+	switch {
+	case m == http.MethodPost && id == "":
+		tusCreate(w, r, user)
+	case id == "" || !tusValidId(id):
+		http.Error(w, "not found", http.StatusNotFound)
+	case m == http.MethodHead:
+		tusHead(w, id, user)
+	case m == http.MethodPatch:
+		tusPatch(w, r, id, user)
+	case m == http.MethodDelete:
+		tusDelete(w, id, user)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func tusCreate(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "deferred length is not supported", http.StatusBadRequest)
+		return
+	}
+	sz, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || sz < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if maxUpload > 0 && uint64(sz) > uint64(maxUpload) {
+		http.Error(w, "upload larger than "+maxUpload.String(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta := tusParseMeta(r.Header.Get("Upload-Metadata"))
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	name = filepath.Base(name)
+	dir := filepath.Clean("/" + meta["dir"])
+	if name == "" || name == "." || name == "/" {
+		http.Error(w, "filename missing in Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	if deniedPfx(dir) || deniedPfx(dir+"/"+name) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	err = checkFree(dir, sz)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	err = os.MkdirAll(*tusDir, 0700)
+	if err != nil {
+		http.Error(w, "unable to create staging dir", http.StatusInternalServerError)
+		log.Printf("tus: %v", err)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	i := tusInfo{
+		ID:      hex.EncodeToString(b),
+		User:    user,
+		Dir:     dir,
+		Name:    name,
+		Size:    sz,
+		Meta:    r.Header.Get("Upload-Metadata"),
+		Expires: time.Now().Add(*tusExpire),
+	}
+	f, err := os.OpenFile(tusPath(i.ID, ".bin"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		http.Error(w, "unable to create upload", http.StatusInternalServerError)
+		log.Printf("tus: %v", err)
+		return
+	}
+	f.Close()
+	err = tusSaveInfo(&i)
+	if err != nil {
+		os.Remove(tusPath(i.ID, ".bin"))
+		http.Error(w, "unable to create upload", http.StatusInternalServerError)
+		log.Printf("tus: %v", err)
+		return
+	}
+	log.Printf("tus: created id=%v dir=%v file=%v size=%v user=%v@%v", i.ID, dir, name, sz, user, r.RemoteAddr)
+
+	w.Header().Set("Location", strings.TrimSuffix(*tusPfx, "/")+"/"+i.ID)
+	w.Header().Set("Upload-Expires", i.Expires.UTC().Format(http.TimeFormat))
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	// creation-with-upload
+	if !tusBusy.lock(i.ID) {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	defer tusBusy.unlock(i.ID)
+	off, err := tusWrite(&i, r, 0)
+	if err != nil {
+		log.Printf("tus: %v", err)
+	}
+	w.Header().Set("Upload-Offset", fmt.Sprint(off))
+	if off == i.Size && err != nil {
+		http.Error(w, "unable to write upload", http.StatusInternalServerError)
+		return
+	}
+	if off == i.Size && !tusComplete(w, &i) {
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusHead(w http.ResponseWriter, id, user string) {
+	i, off, err := tusLoad(id, user)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Upload-Offset", fmt.Sprint(off))
+	w.Header().Set("Upload-Length", fmt.Sprint(i.Size))
+	w.Header().Set("Upload-Expires", i.Expires.UTC().Format(http.TimeFormat))
+	if i.Meta != "" {
+		w.Header().Set("Upload-Metadata", i.Meta)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatch(w http.ResponseWriter, r *http.Request, id, user string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !tusBusy.lock(id) {
+		http.Error(w, "upload in progress", http.StatusLocked)
+		return
+	}
+	defer tusBusy.unlock(id)
+	i, off, err := tusLoad(id, user)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	uOff, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if uOff != off {
+		http.Error(w, "offset mismatch", http.StatusConflict)
+		return
+	}
+	nOff, err := tusWrite(i, r, off)
+	switch err {
+	case nil:
+	case errTusChecksum:
+		http.Error(w, err.Error(), 460)
+		return
+	case errTusAlgorithm:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		log.Printf("tus: %v", err)
+		if nOff == off || nOff == i.Size {
+			http.Error(w, "unable to write upload", http.StatusInternalServerError)
+			return
+		}
+	}
+	// an empty PATCH at the end retries placing a complete upload
+	if nOff == i.Size && !tusComplete(w, i) {
+		return
+	}
+	w.Header().Set("Upload-Offset", fmt.Sprint(nOff))
+	w.Header().Set("Upload-Expires", i.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusDelete(w http.ResponseWriter, id, user string) {
+	if !tusBusy.lock(id) {
+		http.Error(w, "upload in progress", http.StatusLocked)
+		return
+	}
+	defer tusBusy.unlock(id)
+	_, _, err := tusLoad(id, user)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	tusRemove(id)
+	log.Printf("tus: terminated id=%v user=%v", id, user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var (
+	errTusChecksum  = fmt.Errorf("checksum mismatch")
+	errTusAlgorithm = fmt.Errorf("unsupported checksum algorithm")
+)
+
+// tusWrite appends request body to the staged upload at off and returns the new offset,
+// the chunk is discarded if Upload-Checksum doesn't match
+func tusWrite(i *tusInfo, r *http.Request, off int64) (int64, error) {
+	var h hash.Hash
+	var sum []byte
+	if c := r.Header.Get("Upload-Checksum"); c != "" {
+		a := strings.SplitN(c, " ", 2)
+		if len(a) != 2 {
+			return off, errTusAlgorithm
+		}
+		switch a[0] {
+		case "md5":
+			h = md5.New()
+		case "sha1":
+			h = sha1.New()
+		case "sha256":
+			h = sha256.New()
+		default:
+			return off, errTusAlgorithm
+		}
+		var err error
+		sum, err = base64.StdEncoding.DecodeString(a[1])
+		if err != nil {
+			return off, errTusAlgorithm
+		}
+	}
+
+	f, err := os.OpenFile(tusPath(i.ID, ".bin"), os.O_WRONLY, 0600)
+	if err != nil {
+		return off, err
+	}
+	defer f.Close()
+	_, err = f.Seek(off, io.SeekStart)
+	if err != nil {
+		return off, err
+	}
+	var dst io.Writer = f
+	if h != nil {
+		dst = io.MultiWriter(f, h)
+	}
+	n, err := io.Copy(dst, io.LimitReader(r.Body, i.Size-off))
+	if h != nil && (err != nil || string(h.Sum(nil)) != string(sum)) {
+		f.Truncate(off)
+		if err != nil {
+			return off, err
+		}
+		return off, errTusChecksum
+	}
+	if err != nil {
+		// keep whatever was received so the client can resume
+		return off + n, err
+	}
+	if off+n < i.Size {
+		return off + n, nil
+	}
+	return off + n, f.Sync()
+}
+
+// tusComplete moves a complete upload in to place, on failure it answers with
+// an error and keeps the upload so the client can retry with an empty PATCH
+func tusComplete(w http.ResponseWriter, i *tusInfo) bool {
+	err := tusFinish(i)
+	if err == nil {
+		return true
+	}
+	log.Printf("tus: id=%v dir=%v file=%v: %v", i.ID, i.Dir, i.Name, err)
+	c := http.StatusInternalServerError
+	if err == errFileExists {
+		c = http.StatusConflict
+	}
+	http.Error(w, "unable to place upload: "+err.Error(), c)
+	return false
+}
+
+// tusFinish moves a complete staged upload to its destination and removes
+// the staging files, they are left alone if that fails
+func tusFinish(i *tusInfo) error {
+	// no one to ask, keep both files
+	p := *upConflict
+	switch p {
+	case "ask":
+		p = "rename"
+	case "skip":
+		// placeFile would remove the staged file
+		p = "reject"
+	}
+	bin := tusPath(i.ID, ".bin")
+	err := os.Chmod(bin, 0644)
+	if err != nil {
+		return err
+	}
+	tmp := bin
+	if !sameFs(*tusDir, i.Dir) {
+		tmp, err = tusStage(bin, i.Dir)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := placeFile(tmp, i.Dir, i.Name, p)
+	if err != nil {
+		if tmp != bin {
+			os.Remove(tmp)
+		}
+		return err
+	}
+	i.Name = n
+	os.Remove(bin)
+	os.Remove(tusPath(i.ID, ".json"))
+	log.Printf("tus: completed id=%v dir=%v file=%v size=%v user=%v", i.ID, i.Dir, i.Name, i.Size, i.User)
+	return nil
+}
+
+// tusStage copies a completed upload to a temp file in dir when the staging
+// directory is on a different filesystem, so it can be renamed in to place
+func tusStage(bin, dir string) (string, error) {
+	i, err := os.Open(bin)
+	if err != nil {
+		return "", err
+	}
+	defer i.Close()
+	o, err := os.CreateTemp(dir, ".wfm-upload-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(o, i)
+	if err == nil {
+		err = o.Chmod(0644)
+	}
+	if err == nil {
+		err = o.Sync()
+	}
+	if err == nil {
+		err = o.Close()
+	} else {
+		o.Close()
+	}
+	if err != nil {
+		os.Remove(o.Name())
+		return "", err
+	}
+	return o.Name(), nil
+}
+
+func tusLoad(id, user string) (*tusInfo, int64, error) {
+	j, err := ioutil.ReadFile(tusPath(id, ".json"))
+	if err != nil {
+		return nil, 0, err
+	}
+	i := &tusInfo{}
+	err = json.Unmarshal(j, i)
+	if err != nil {
+		return nil, 0, err
+	}
+	if i.User != user || time.Now().After(i.Expires) {
+		return nil, 0, fmt.Errorf("not found")
+	}
+	f, err := os.Stat(tusPath(id, ".bin"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return i, f.Size(), nil
+}
+
+func tusSaveInfo(i *tusInfo) error {
+	j, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tusPath(i.ID, ".json"), j, 0600)
+}
+
+func tusRemove(id string) {
+	os.Remove(tusPath(id, ".bin"))
+	os.Remove(tusPath(id, ".json"))
+}
+
+func tusPath(id, ext string) string {
+	return filepath.Join(*tusDir, id+ext)
+}
+
+func tusValidId(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+func tusParseMeta(m string) map[string]string {
+	o := make(map[string]string)
+	for _, kv := range strings.Split(m, ",") {
+		p := strings.SplitN(strings.TrimSpace(kv), " ", 2)
+		if p[0] == "" {
+			continue
+		}
+		if len(p) == 1 {
+			o[p[0]] = ""
+			continue
+		}
+		v, err := base64.StdEncoding.DecodeString(p[1])
+		if err != nil {
+			continue
+		}
+		o[p[0]] = string(v)
+	}
+	return o
+}
+
+// tusPurge periodically removes abandoned uploads past their expiry time
+func tusPurge() {
+	for {
+		d, _ := ioutil.ReadDir(*tusDir)
+		for _, f := range d {
+			if !strings.HasSuffix(f.Name(), ".json") {
+				continue
+			}
+			id := strings.TrimSuffix(f.Name(), ".json")
+			if !tusBusy.lock(id) {
+				continue
+			}
+			j, err := ioutil.ReadFile(tusPath(id, ".json"))
+			i := tusInfo{}
+			if err == nil {
+				err = json.Unmarshal(j, &i)
+			}
+			if err != nil || time.Now().After(i.Expires) {
+				log.Printf("tus: purging expired upload id=%v file=%v", id, i.Name)
+				tusRemove(id)
+			}
+			tusBusy.unlock(id)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// versions of a file are kept in versions_dir/<hash of path>/ named by the time
+// they were replaced, the original path is recorded in the "path" file
+
+const verTime = "20060102T150405.000000000"
+
+type version struct {
+	ID    string
+	Saved time.Time
+	fi    os.FileInfo
+}
+
+func verStore(fp string) string {
+	h := sha256.Sum256([]byte(filepath.Clean(fp)))
+	return *verDir + "/" + hex.EncodeToString(h[:8])
+}
+
+// saveVersion copies fp to its version store before it gets replaced, kind is
+// "edit" for text editor saves and restores or "upload" for uploaded overwrites
+func saveVersion(fp, kind string) error {
+	if *versions == "off" || (*versions == "edit" && kind != "edit") {
+		return nil
+	}
+	fp = filepath.Clean(fp)
+	fi, err := os.Stat(fp)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	s := verStore(fp)
+	err = os.MkdirAll(s, 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(s+"/path", []byte(fp), 0600)
+	if err != nil {
+		return err
+	}
+	i, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer i.Close()
+	o, err := os.CreateTemp(s, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(o.Name())
+	_, err = io.Copy(o, i)
+	if err != nil {
+		o.Close()
+		return err
+	}
+	err = o.Close()
+	if err != nil {
+		return err
+	}
+	os.Chtimes(o.Name(), fi.ModTime(), fi.ModTime())
+	err = os.Rename(o.Name(), s+"/"+time.Now().Format(verTime))
+	if err != nil {
+		return err
+	}
+	pruneVersions(s)
+	return nil
+}
+
+// listVersions returns versions of fp, newest first
+func listVersions(fp string) []version {
+	l := []version{}
+	s := verStore(fp)
+	p, err := ioutil.ReadFile(s + "/path")
+	if err != nil || string(p) != filepath.Clean(fp) {
+		return l
+	}
+	d, _ := ioutil.ReadDir(s)
+	for _, f := range d {
+		t, err := time.ParseInLocation(verTime, f.Name(), time.Local)
+		if err != nil {
+			continue
+		}
+		l = append(l, version{ID: f.Name(), Saved: t, fi: f})
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].ID > l[j].ID
+	})
+	return l
+}
+
+func hasVersions(fp string) bool {
+	if *versions == "off" {
+		return false
+	}
+	_, err := os.Stat(verStore(fp))
+	return err == nil
+}
+
+// pruneVersions removes versions beyond versions_keep count or older than versions_expire
+func pruneVersions(s string) {
+	d, _ := ioutil.ReadDir(s)
+	n := 0
+	for i := len(d) - 1; i >= 0; i-- {
+		t, err := time.ParseInLocation(verTime, d[i].Name(), time.Local)
+		if err != nil {
+			continue
+		}
+		n++
+		if (*verKeep > 0 && n > *verKeep) || (*verExpire > 0 && time.Since(t) > *verExpire) {
+			os.Remove(s + "/" + d[i].Name())
+		}
+	}
+	d, _ = ioutil.ReadDir(s)
+	if len(d) == 1 && d[0].Name() == "path" {
+		os.RemoveAll(s)
+	}
+}
+
+// verPurge periodically applies versions_expire to files which are not being saved anymore
+func verPurge() {
+	for {
+		if *verExpire > 0 {
+			d, _ := ioutil.ReadDir(*verDir)
+			for _, f := range d {
+				if f.IsDir() {
+					pruneVersions(*verDir + "/" + f.Name())
+				}
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// verFile returns path of version uVer of file uFp
+func verFile(uFp, uVer string) (string, error) {
+	if *versions == "off" {
+		return "", fmt.Errorf("versioning is disabled")
+	}
+	for _, v := range listVersions(uFp) {
+		if v.ID == uVer {
+			return verStore(uFp) + "/" + v.ID, nil
+		}
+	}
+	return "", fmt.Errorf("version not found")
+}
+
+func listHistory(w http.ResponseWriter, uFp, eSort string) {
+	if deniedPfx(uFp) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	uFp = filepath.Clean(uFp)
+	fi, err := os.Stat(uFp)
+	if err != nil {
+		htErr(w, "history", err)
+		return
+	}
+	qFp := url.QueryEscape(uFp)
+	header(w, filepath.Dir(uFp), eSort)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD COLSPAN="4" BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; History of ` + html.EscapeString(uFp) + `</FONT></TD></TR>
+    <TR BGCOLOR="#A0A0A0">
+    <TD NOWRAP><FONT COLOR="#FFFFFF">Version</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Size</FONT></TD>
+    <TD NOWRAP ALIGN="right"><FONT COLOR="#FFFFFF">Modified</FONT></TD>
+    <TD NOWRAP ALIGN="right">&nbsp;</TD>
+    </TR>
+    `))
+	fmt.Fprintf(w, `<TR BGCOLOR="#FFFFFF"><TD NOWRAP>current</TD><TD NOWRAP ALIGN="right">%v</TD><TD NOWRAP ALIGN="right">(%v) %v</TD>`+
+		`<TD NOWRAP ALIGN="right"><A HREF="%v?fn=disp&amp;fp=%v">view</A>&nbsp;</TD></TR>`+"\n",
+		humanize.Bytes(uint64(fi.Size())), humanize.Time(fi.ModTime()), fi.ModTime().Format(time.Stamp),
+		*wfmPfx, qFp)
+	for n, v := range listVersions(uFp) {
+		bg := "#F0F0F0"
+		if n%2 == 1 {
+			bg = "#FFFFFF"
+		}
+		l := *wfmPfx + "?fp=" + qFp + "&amp;v=" + url.QueryEscape(v.ID) + "&amp;sort=" + html.EscapeString(eSort) + "&amp;fn="
+		fmt.Fprintf(w, `<TR BGCOLOR="%v"><TD NOWRAP>replaced %v</TD><TD NOWRAP ALIGN="right">%v</TD><TD NOWRAP ALIGN="right">(%v) %v</TD>`+
+			`<TD NOWRAP ALIGN="right"><A HREF="%vverview">view</A>&nbsp; <A HREF="%vverdiff">diff</A>&nbsp; `+
+			`<A HREF="%vverdown">download</A>&nbsp; <A HREF="%vverrestp">restore</A>&nbsp;</TD></TR>`+"\n",
+			bg, v.Saved.Format(time.Stamp), humanize.Bytes(uint64(v.fi.Size())), humanize.Time(v.fi.ModTime()), v.fi.ModTime().Format(time.Stamp),
+			l, l, l, l)
+	}
+	w.Write([]byte(`
+    </TABLE><P>
+    &nbsp;<INPUT TYPE="SUBMIT" VALUE=" OK " NAME="OK">
+    `))
+	footer(w)
+}
+
+func viewVersion(w http.ResponseWriter, r *http.Request, uFp, uVer string, down bool) {
+	if deniedPfx(uFp) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	vf, err := verFile(uFp, uVer)
+	if err != nil {
+		htErr(w, "version", err)
+		return
+	}
+	if !down {
+		inlineFile(w, r, vf)
+		return
+	}
+	f, err := os.Open(vf)
+	if err != nil {
+		htErr(w, "Unable top open file", err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(uFp)+"\";")
+	serveFile(w, r, f)
+}
+
+func diffVersion(w http.ResponseWriter, uFp, uVer, eSort string) {
+	if deniedPfx(uFp) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	vf, err := verFile(uFp, uVer)
+	if err != nil {
+		htErr(w, "version", err)
+		return
+	}
+	a, err := readText(vf)
+	if err != nil {
+		htErr(w, "diff", err)
+		return
+	}
+	b, err := readText(uFp)
+	if err != nil {
+		htErr(w, "diff", err)
+		return
+	}
+	dl, err := diffText(a, b)
+	if err != nil {
+		htErr(w, "diff", err)
+		return
+	}
+	header(w, filepath.Dir(uFp), eSort)
+	w.Write([]byte(`
+    <TABLE WIDTH="100%" BGCOLOR="#FFFFFF" CELLPADDING="0" CELLSPACING="0" BORDER="0">
+    <TR><TD BGCOLOR="#004080"><FONT COLOR="#FFFFFF">&nbsp; ` + html.EscapeString(filepath.Base(uFp)) +
+		` version replaced ` + html.EscapeString(strings.SplitN(uVer, ".", 2)[0]) + ` (-) against current (+)</FONT></TD></TR>
+    <TR><TD>
+    `))
+	diffHtml(w, dl, 3)
+	w.Write([]byte(`
+    </TD></TR></TABLE><P>
+    &nbsp;<INPUT TYPE="SUBMIT" VALUE=" OK " NAME="OK">
+    <INPUT TYPE="HIDDEN" NAME="fn" VALUE="history">
+    <INPUT TYPE="HIDDEN" NAME="fp" VALUE="` + html.EscapeString(uFp) + `">
+    `))
+	footer(w)
+}
+
+// readText reads a file for diffing, refusing large and binary files
+func readText(fp string) (string, error) {
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() > 1<<20 {
+		return "", fmt.Errorf("the file is too large for diff")
+	}
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsRune(string(b), 0) {
+		return "", fmt.Errorf("binary files can not be compared")
+	}
+	return string(b), nil
+}
+
+func restoreVersion(w http.ResponseWriter, uFp, uVer, eSort string, rw bool) {
+	if !rw {
+		htErr(w, "permission", fmt.Errorf("read only"))
+		return
+	}
+	if deniedPfx(uFp) {
+		htErr(w, "access", fmt.Errorf("forbidden"))
+		return
+	}
+	uFp = filepath.Clean(uFp)
+	vf, err := verFile(uFp, uVer)
+	if err != nil {
+		htErr(w, "restore", err)
+		return
+	}
+	i, err := os.Open(vf)
+	if err != nil {
+		htErr(w, "restore", err)
+		return
+	}
+	defer i.Close()
+	tmp, err := writeTemp(uFp, i)
+	if err != nil {
+		htErr(w, "restore", err)
+		return
+	}
+	defer os.Remove(tmp)
+	// keep current contents so the restore can be undone
+	err = saveVersion(uFp, "edit")
+	if err != nil {
+		htErr(w, "restore", err)
+		return
+	}
+	err = os.Rename(tmp, uFp)
+	if err != nil {
+		htErr(w, "restore", err)
+		return
+	}
+	err = syncDir(filepath.Dir(uFp))
+	if err != nil {
+		log.Printf("unable to sync directory of %v: %v", uFp, err)
+	}
+	log.Printf("Restored version %v of %v", uVer, uFp)
+	redirect(w, *wfmPfx+"?fn=history&fp="+url.QueryEscape(uFp)+"&sort="+eSort)
+}
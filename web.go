@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -20,6 +21,36 @@ func htErr(w http.ResponseWriter, msg string, err error) {
 
 func header(w http.ResponseWriter, uDir, sort string) {
 	eDir := html.EscapeString(uDir)
+	uSort, uFlt := splitView(sort)
+	htHead(w, "WFM "+eDir)
+	w.Write([]byte(`
+    <FORM ACTION="` + *wfmPfx + `" METHOD="POST" ENCTYPE="multipart/form-data">
+    <INPUT TYPE="hidden" NAME="dir" VALUE="` + eDir + `">
+    <INPUT TYPE="hidden" NAME="sort" VALUE="` + html.EscapeString(uSort) + `">
+    `))
+	if uFlt != "" {
+		w.Write([]byte(`<INPUT TYPE="hidden" NAME="flt" VALUE="` + html.EscapeString(uFlt) + `">` + "\n"))
+	}
+}
+
+// viewQuery returns escaped sort order followed by the listing filter as its
+// own flt parameter, it's passed around as eSort and appended to "&sort="
+func viewQuery(uSort, uFlt string) string {
+	q := url.QueryEscape(uSort)
+	if uFlt != "" {
+		q += "&flt=" + url.QueryEscape(uFlt)
+	}
+	return q
+}
+
+// splitView returns sort order and filter of eSort made by viewQuery
+func splitView(eSort string) (string, string) {
+	v, _ := url.ParseQuery("sort=" + eSort)
+	return v.Get("sort"), v.Get("flt")
+}
+
+// htHead writes html head and opens body, eTitle must be html escaped
+func htHead(w http.ResponseWriter, eTitle string) {
 	w.Header().Set("Content-Type", "text/html")
 	w.Header().Set("Cache-Control", *cacheCtl)
 	w.Write([]byte(`
@@ -34,7 +65,7 @@ func header(w http.ResponseWriter, uDir, sort string) {
     <META NAME="viewport" CONTENT="width=device-width">
     <LINK REL="icon" TYPE="image/x-icon" HREF="/favicon.ico">
     <LINK REL="shortcut icon" HREF="/favicon.ico?">
-    <TITLE>WFM ` + eDir + `</TITLE>
+    <TITLE>` + eTitle + `</TITLE>
     <STYLE TYPE="text/css"><!--
             A:link {text-decoration: none; color:#0000CE; }
             A:visited {text-decoration: none; color:#0000CE; }
@@ -49,9 +80,6 @@ func header(w http.ResponseWriter, uDir, sort string) {
     --></STYLE>
     </HEAD>
     <BODY BGCOLOR="#FFFFFF">
-    <FORM ACTION="` + *wfmPfx + `" METHOD="POST" ENCTYPE="multipart/form-data">
-    <INPUT TYPE="hidden" NAME="dir" VALUE="` + eDir + `">
-    <INPUT TYPE="hidden" NAME="sort" VALUE="` + sort + `">
     `))
 }
 
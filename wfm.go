@@ -13,13 +13,17 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	_ "github.com/breml/rootcerts"
+	"github.com/dustin/go-humanize"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 type multiString []string
 
+type byteSize uint64
+
 var (
 	vers        = "2.0.2"
 	bindProto   = flag.String("proto", "tcp", "tcp, tcp4, tcp6, etc")
@@ -40,9 +44,43 @@ var (
 	acmBind     = flag.String("acm_addr", "", "autocert manager listen address, eg: :80")
 	acmWhlist   multiString // this flag set in main
 	denyPfxs    multiString
+	chownUsers  multiString
+	chownGroups multiString
+	maxUpload   byteSize
+	minFree     byteSize
+	arcMaxSize  = byteSize(10 << 30)
+	idxMax      = byteSize(8 << 20)
+	extMaxSize  = byteSize(10 << 30)
 	allowAcmDir = flag.Bool("allow_acm_dir", false, "allow access to acm cache dir (insecure!)")
 	f2bEnabled  = flag.Bool("f2b", true, "ban ip addresses on user/pass failures")
 	f2bDump     = flag.String("f2b_dump", "", "enable f2b dump at this prefix, eg. /f2bdump (default no)")
+	arcMaxFiles = flag.Int("arc_max_files", 100000, "maximum number of entries in a downloaded archive")
+	sevenZip    = flag.String("compress_7z", "7z", "program for creating 7z archives, eg. 7z, 7za or 7zz, empty to disable")
+	extMaxFiles = flag.Int("extract_max_files", 100000, "maximum number of entries in an extracted archive")
+	extMaxRatio = flag.Int("extract_max_ratio", 100, "maximum ratio of extracted size to archive size, 0 for unlimited")
+	upConflict  = flag.String("upload_conflict", "ask", "when uploaded file exists: ask, overwrite, rename, reject, backup")
+	sharePfx    = flag.String("share_pfx", "/share/", "public share links prefix, empty to disable")
+	shareDb     = flag.String("share_db", "/.wfm-shares.json", "share links database file (inside chroot)")
+	tusPfx      = flag.String("tus_pfx", "/tus/", "tus resumable upload endpoint prefix, empty to disable")
+	tusDir      = flag.String("tus_dir", "/.wfm-tus", "tus upload staging directory (inside chroot)")
+	tusExpire   = flag.Duration("tus_expire", 24*time.Hour, "remove unfinished tus uploads after this time")
+	trashDir    = flag.String("trash_dir", "/.wfm-trash", "trash directory for deleted files (inside chroot)")
+	trashExpire = flag.Duration("trash_expire", 30*24*time.Hour, "purge deleted files from trash after this time, 0 to keep forever")
+	hardDelete  = flag.Bool("hard_delete", false, "delete files immediately instead of moving them to trash")
+	versions    = flag.String("versions", "edit", "keep previous versions of files: off, edit (editor saves), all (also overwriting uploads)")
+	verDir      = flag.String("versions_dir", "/.wfm-versions", "directory for previous versions of files (inside chroot)")
+	verKeep     = flag.Int("versions_keep", 10, "number of versions to keep per file, 0 for unlimited")
+	verExpire   = flag.Duration("versions_expire", 0, "remove versions older than this, 0 to keep regardless of age")
+	edLockTime  = flag.Duration("edit_lock", 15*time.Minute, "show who opened a file in editor for this long, 0 to disable")
+	searchMax   = flag.Int("search_max", 1000, "stop file search after this many results")
+	searchTime  = flag.Duration("search_timeout", 30*time.Second, "stop file search after this time")
+	idxOn       = flag.Bool("index", false, "keep full-text index of text files and office documents for content search")
+	idxDir      = flag.String("index_dir", "/.wfm-index", "content index directory (inside chroot)")
+	idxRoot     = flag.String("index_root", "/", "directory tree to index (inside chroot)")
+	idxRescan   = flag.Duration("index_rescan", time.Hour, "rescan interval for updating the content index")
+	duOn        = flag.Bool("du", true, "compute directory sizes in background")
+	duTTL       = flag.Duration("du_ttl", time.Hour, "recompute cached directory sizes after this time")
+	fsWarn      = flag.Int("fs_warn", 90, "highlight filesystem usage above this percent full")
 )
 
 func userId(usr string) (int, int, error) {
@@ -85,10 +123,30 @@ func (z *multiString) Set(v string) error {
 	return nil
 }
 
+func (b *byteSize) String() string {
+	return humanize.Bytes(uint64(*b))
+}
+
+func (b *byteSize) Set(v string) error {
+	s, err := humanize.ParseBytes(v)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(s)
+	return nil
+}
+
 func main() {
 	var err error
 	flag.Var(&acmWhlist, "acm_host", "autocert manager allowed hostname (multi)")
 	flag.Var(&denyPfxs, "deny_pfx", "deny access / hide this path prefix (multi)")
+	flag.Var(&chownUsers, "chown_user", "user name files can be given to in properties (multi)")
+	flag.Var(&chownGroups, "chown_group", "group name files can be given to in properties (multi)")
+	flag.Var(&maxUpload, "max_upload", "maximum upload file size, eg: 4GB (default unlimited)")
+	flag.Var(&minFree, "min_free", "refuse uploads leaving less free disk space than this, eg: 1GB")
+	flag.Var(&arcMaxSize, "arc_max_size", "maximum total size of files in a downloaded archive")
+	flag.Var(&extMaxSize, "extract_max_size", "maximum total size of files extracted from an archive")
+	flag.Var(&idxMax, "index_max_size", "do not index files larger than this")
 	flag.Parse()
 
 	if flag.Arg(0) == "user" {
@@ -106,6 +164,33 @@ func main() {
 		denyPfxs = append(denyPfxs, *acmDir)
 	}
 
+	switch *upConflict {
+	case "ask", "overwrite", "rename", "reject", "backup":
+	default:
+		log.Fatalf("invalid -upload_conflict policy %q", *upConflict)
+	}
+
+	switch *versions {
+	case "off":
+	case "edit", "all":
+		denyPfxs = append(denyPfxs, *verDir)
+	default:
+		log.Fatalf("invalid -versions mode %q", *versions)
+	}
+
+	if *tusPfx != "" {
+		denyPfxs = append(denyPfxs, *tusDir)
+	}
+	if *sharePfx != "" {
+		denyPfxs = append(denyPfxs, *shareDb)
+	}
+	if !*hardDelete {
+		denyPfxs = append(denyPfxs, *trashDir)
+	}
+	if *idxOn || flag.Arg(0) == "index" {
+		denyPfxs = append(denyPfxs, *idxDir)
+	}
+
 	if *logFile != "" {
 		lf, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
@@ -144,6 +229,16 @@ func main() {
 		log.Printf("Chroot to %q", *chrootDir)
 	}
 
+	// rebuild content index as the user server runs as, so it can keep updating it
+	if flag.Arg(0) == "index" {
+		err = setUid(suid, sgid)
+		if err != nil {
+			log.Fatalf("unable to suid for %v: %v", *suidUser, err)
+		}
+		ftIndex.rebuild()
+		return
+	}
+
 	// listen/bind to port before setuid
 	l, err := net.Listen(*bindProto, *bindAddr)
 	if err != nil {
@@ -161,6 +256,11 @@ func main() {
 	}
 	log.Printf("Setuid UID=%d GID=%d", os.Geteuid(), os.Getgid())
 
+	// share db lives inside chroot
+	if *sharePfx != "" {
+		shares.load()
+	}
+
 	// http stuff
 	mux := http.NewServeMux()
 	mux.HandleFunc(*wfmPfx, wfm)
@@ -168,6 +268,25 @@ func main() {
 	if *f2bDump != "" {
 		mux.HandleFunc(*f2bDump, dumpf2b)
 	}
+	if *sharePfx != "" {
+		mux.HandleFunc(*sharePfx, shareHandler)
+	}
+	if *tusPfx != "" {
+		mux.HandleFunc(*tusPfx, tusHandler)
+		go tusPurge()
+	}
+	if !*hardDelete {
+		go trashPurge()
+	}
+	if *versions != "off" {
+		go verPurge()
+	}
+	if *idxOn {
+		go ftIndex.run()
+	}
+	if *duOn {
+		go duCache.run()
+	}
 	if *docSrv != "" {
 		ds := strings.Split(*docSrv, ":")
 		log.Printf("Starting doc handler for dir %v at %v", ds[0], ds[1])
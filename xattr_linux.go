@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// copyXattrs copies extended attributes, including POSIX ACLs, from src to dst, best effort
+func copyXattrs(src, dst string) {
+	sz, err := syscall.Listxattr(src, nil)
+	if err != nil || sz <= 0 {
+		return
+	}
+	l := make([]byte, sz)
+	sz, err = syscall.Listxattr(src, l)
+	if err != nil {
+		return
+	}
+	for _, n := range bytes.Split(l[:sz], []byte{0}) {
+		if len(n) == 0 {
+			continue
+		}
+		vs, err := syscall.Getxattr(src, string(n), nil)
+		if err != nil {
+			continue
+		}
+		v := make([]byte, vs)
+		vs, err = syscall.Getxattr(src, string(n), v)
+		if err != nil {
+			continue
+		}
+		syscall.Setxattr(dst, string(n), v[:vs], 0)
+	}
+}